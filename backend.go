@@ -0,0 +1,290 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"syscall/js"
+)
+
+// Backend is a SQLite build reachable from JS which the driver opens databases with. The
+// built-in backends are NewSQLJSBackend for sql.js and NewOO1Backend for the official SQLite
+// WASM build.
+type Backend interface {
+	// Open opens the database called name, creating it if it doesn't exist.
+	Open(name string) (BackendDB, error)
+}
+
+// VFSBackend is a Backend which can open databases with a particular SQLite VFS, such as "opfs"
+// for the Origin Private File System. It is used for DSNs with the vfs parameter.
+type VFSBackend interface {
+	Backend
+	// OpenVFS opens the database called name with the VFS called vfs, creating it if it
+	// doesn't exist.
+	OpenVFS(name, vfs string) (BackendDB, error)
+}
+
+// BackendDB is a database opened by a Backend.
+type BackendDB interface {
+	// Prepare prepares the first statement of query, returning it along with the rest of
+	// query. stmt is nil if query holds no statements.
+	Prepare(query string) (stmt BackendStmt, tail string, err error)
+	// Changes returns the number of rows changed by the last INSERT, UPDATE or DELETE.
+	Changes() (int64, error)
+	// LastInsertRowID returns the rowid of the last INSERT.
+	LastInsertRowID() (int64, error)
+	// Export serializes the database.
+	Export() ([]byte, error)
+	// Close closes the database.
+	Close() error
+	// JS returns the JS database object.
+	JS() js.Value
+}
+
+// BackendStmt is a statement prepared by a BackendDB.
+type BackendStmt interface {
+	// SQL returns the text of the statement.
+	SQL() string
+	// NumParams returns the number of placeholders in the statement.
+	NumParams() int
+	// Bind binds args to the placeholders of the statement.
+	Bind(args []driver.Value) error
+	// Step steps to the next row, reporting whether there is one.
+	Step() (bool, error)
+	// ColumnNames returns the names of the result columns.
+	ColumnNames() ([]string, error)
+	// Row reads the current row into dest.
+	Row(dest []driver.Value) error
+	// Reset resets the statement and clears its bindings, ready to be run again.
+	Reset() error
+	// Finalize frees the statement.
+	Finalize() error
+	// JS returns the JS statement object.
+	JS() js.Value
+}
+
+// Fast paths a BackendStmt may implement, which the built-in backends do with JS helpers in a
+// single call across the Go/JS boundary, imageOpener, backuper and memoryStatser which a
+// BackendDB may implement, and interrupter which a BackendStmt may implement. The driver falls
+// back to the BackendStmt methods for backends which don't.
+type (
+	stmtExecer interface {
+		// exec runs the statement once with args, returning the number of rows changed and
+		// the rowid of the last insert.
+		exec(args []driver.Value) (changes, id int64, err error)
+	}
+	stmtBulkExecer interface {
+		// bulkExec runs the statement once for each of rows inside a savepoint, returning
+		// the total number of rows changed and the rowid of the last insert.
+		bulkExec(rows [][]driver.Value) (changes, id int64, err error)
+	}
+	stmtRowFetcher interface {
+		// fetchRows reads up to max rows starting at the current one, stepping past each,
+		// and reports whether there are more.
+		fetchRows(max int) (batch rowBatch, more bool, err error)
+	}
+	imageOpener interface {
+		// openImage opens a new in-memory database in the same SQLite build, holding the
+		// database serialized in data by Export.
+		openImage(data []byte) (BackendDB, error)
+	}
+	backuper interface {
+		// backup starts an online backup of the database into dst, or returns nil if the
+		// build can't back up into dst.
+		backup(dst BackendDB) (backupStepper, error)
+	}
+	backupStepper interface {
+		// step copies up to pages pages, or all of them if pages is negative, reporting
+		// whether the backup is done and how many of the total pages are left to copy.
+		step(pages int) (done bool, remaining, total int, err error)
+		// finish frees the backup, whether done or not.
+		finish() error
+	}
+	memoryStatser interface {
+		// memoryStats returns the bytes allocated by SQLite now and at most, and the bytes of
+		// wasm memory of the build, each -1 if unknown.
+		memoryStats() (used, highwater, heap int64)
+	}
+	interrupter interface {
+		// interrupt makes the calls running on a BackendStmt, and those queued behind them,
+		// fail as soon as possible, without affecting other statements of the BackendDB.
+		interrupt()
+	}
+	stmtColumnTyper interface {
+		// columnTypes describes the result columns, including the storage class of their
+		// values in the current row if hasRow.
+		columnTypes(hasRow bool) ([]columnType, error)
+	}
+	stmtFreer interface {
+		// freed reports whether the statement was freed behind the driver's back, as sql.js
+		// does to every statement on Database.export().
+		freed() bool
+	}
+	stmtStatuser interface {
+		// status returns the sqlite3_stmt_status counters of the statement since they were
+		// last read, if the backend exposes them.
+		status() (stmtStatus, bool)
+	}
+)
+
+// readStmtStatus returns the sqlite3_stmt_status counters of s since they were last read, or
+// zeros and false if the backend doesn't expose them.
+func readStmtStatus(s BackendStmt) (stmtStatus, bool) {
+	if st, ok := s.(stmtStatuser); ok {
+		return st.status()
+	}
+	return stmtStatus{}, false
+}
+
+// stmtFreed reports whether s was freed behind the driver's back, if the backend can tell.
+func stmtFreed(s BackendStmt) bool {
+	f, ok := s.(stmtFreer)
+	return ok && f.freed()
+}
+
+// stmtInterrupt interrupts the calls running on s, if the backend supports it.
+func stmtInterrupt(s BackendStmt) {
+	if i, ok := s.(interrupter); ok {
+		i.interrupt()
+	}
+}
+
+// stmtExec runs s once with args, returning the number of rows changed and the rowid of the
+// last insert.
+func stmtExec(db BackendDB, s BackendStmt, args []driver.Value) (changes, id int64, err error) {
+	if e, ok := s.(stmtExecer); ok {
+		return e.exec(args)
+	}
+	if err = s.Bind(args); err == nil {
+		_, err = s.Step()
+	}
+	if rerr := s.Reset(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if changes, err = db.Changes(); err != nil {
+		return 0, 0, err
+	}
+	id, err = db.LastInsertRowID()
+	return changes, id, err
+}
+
+// stmtBulkExec runs s once for each of rows inside a savepoint, which is rolled back if any row
+// fails. It returns the total number of rows changed and the rowid of the last insert.
+func stmtBulkExec(db BackendDB, s BackendStmt, rows [][]driver.Value) (changes, id int64, err error) {
+	if e, ok := s.(stmtBulkExecer); ok {
+		return e.bulkExec(rows)
+	}
+	if err = backendExec(db, "SAVEPOINT go_sqlite_bulk"); err != nil {
+		return 0, 0, err
+	}
+	for i, row := range rows {
+		var n int64
+		if n, id, err = stmtExec(db, s, row); err != nil {
+			if rerr := backendExec(db, "ROLLBACK TO go_sqlite_bulk; RELEASE go_sqlite_bulk"); rerr != nil {
+				return 0, 0, fmt.Errorf("row %d: %s (rollback: %s)", i, err, rerr)
+			}
+			return 0, 0, fmt.Errorf("row %d: %s", i, err)
+		}
+		changes += n
+	}
+	if err = backendExec(db, "RELEASE go_sqlite_bulk"); err != nil {
+		return 0, 0, err
+	}
+	return changes, id, nil
+}
+
+// backendExec runs each statement of query in turn, without args.
+func backendExec(db BackendDB, query string) error {
+	for {
+		s, tail, err := db.Prepare(query)
+		if err != nil || s == nil {
+			return err
+		}
+		_, _, err = stmtExec(db, s, nil)
+		if ferr := s.Finalize(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
+		query = tail
+	}
+}
+
+// backendQueryRows runs query with args and returns all of its rows.
+func backendQueryRows(db BackendDB, query string, args ...driver.Value) (rows [][]driver.Value, err error) {
+	s, _, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("nothing to query, query: %s", query)
+	}
+	defer func() {
+		if ferr := s.Finalize(); err == nil {
+			err = ferr
+		}
+	}()
+	if err = s.Bind(args); err != nil {
+		return nil, err
+	}
+	cols, err := s.ColumnNames()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ok, err := s.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return rows, nil
+		}
+		row := make([]driver.Value, len(cols))
+		if err = s.Row(row); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+// backendQueryInt runs query with args, which returns a single integer such as a PRAGMA, and
+// returns it.
+func backendQueryInt(db BackendDB, query string, args ...driver.Value) (int64, error) {
+	rows, err := backendQueryRows(db, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return 0, fmt.Errorf("no rows, query: %s", query)
+	}
+	n, ok := rows[0][0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("got %T, want an integer, query: %s", rows[0][0], query)
+	}
+	return n, nil
+}
+
+// backendExplain returns the plan of query with args from EXPLAIN QUERY PLAN.
+func backendExplain(db BackendDB, query string, args ...driver.Value) ([]*PlanNode, error) {
+	rows, err := backendQueryRows(db, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*PlanNode, 0, len(rows))
+	for _, row := range rows {
+		if len(row) < 4 {
+			return nil, fmt.Errorf("got %d columns, want 4, query: EXPLAIN QUERY PLAN %s", len(row), query)
+		}
+		id, _ := row[0].(int64)
+		parent, _ := row[1].(int64)
+		detail, _ := row[3].(string)
+		nodes = append(nodes, &PlanNode{ID: int(id), Parent: int(parent), Detail: detail})
+	}
+	return planTree(nodes), nil
+}
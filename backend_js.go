@@ -0,0 +1,410 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sync/atomic"
+	"syscall/js"
+)
+
+// jsBackend is a Backend built on a JS adapter object, which maps a small set of functions onto
+// the object model of a particular SQLite WASM build:
+//
+//	open(name) -> db, openImage(data) -> a new in-memory db holding the serialized database data
+//	prepare(db, sql) -> {stmt, sql, tail}, where sql is the text of the first statement and tail the rest
+//	paramCount(stmt) -> number, or -1 if unknown
+//	bind(stmt, args), step(stmt) -> bool, get(stmt) -> array, columnNames(stmt) -> array
+//	reset(stmt), which also clears the bindings, and finalize(stmt)
+//	exec(db, sql), selectRow(db, sql, params) -> array or null
+//	changes(db) -> number, lastInsertRowid(db) -> number, export(db) -> Uint8Array, close(db)
+//	columnString(stmt, fn, i) -> the result of sqlite3_column_<fn>, or null if unreachable
+//	columnType(stmt, i) -> the result of sqlite3_column_type, or -1 if unreachable
+//	tableColumnMetadata(db, schema, table, column) -> {decltype, notnull}, or null if unreachable
+//	backupInit(dst, src) -> a sqlite3_backup of the main database of src into dst, or null if
+//	unreachable, backupStep(dst, backup, pages) -> [done, remaining, pagecount] and
+//	backupFinish(dst, backup)
+//	memory() -> {used, highwater} of sqlite3_memory_used/highwater and the bytes of wasm memory
+//	heap, each null if unreachable
+//	stmtStatus(stmt) -> the sqlite3_stmt_status counters [FULLSCAN_STEP, SORT, AUTOINDEX], reset
+//	as they are read, or null if unreachable
+//	freed(stmt) -> whether the statement was freed other than by finalize, e.g. by export
+//
+// and optionally openVFS(name, vfs) -> db, for builds with several VFSes.
+//
+// The JS helpers are built on the same adapter.
+type jsBackend struct {
+	adapter js.Value
+	helpers js.Value
+}
+
+// jsAdapterPrelude is compiled along with every adapter source.
+const jsAdapterPrelude = `
+"use strict";
+
+// prepared returns the result of prepare for stmt, prepared from the first statement of sql and
+// whose text as reported by sqlite3_sql is text.
+function prepared(stmt, text, sql) {
+	if (typeof text !== "string" || !sql.startsWith(text)) {
+		// the build doesn't report where the statement ends, so treat it as the whole of sql
+		return {stmt: stmt, sql: sql, tail: ""};
+	}
+	return {stmt: stmt, sql: text, tail: sql.slice(text.length)};
+}
+`
+
+// newJSBackend compiles adapterSource, the body of a function of the SQL module returning the
+// adapter, and builds a backend on the adapter it returns for module.
+func newJSBackend(module js.Value, adapterSource string) *jsBackend {
+	adapter := js.Global().Get("Function").New("SQL", jsAdapterPrelude+adapterSource).Invoke(module)
+	return &jsBackend{
+		adapter: adapter,
+		helpers: newJSHelpers(adapter),
+	}
+}
+
+// jsCaller calls the functions of a JS adapter and the JS helpers built on it, which may run
+// on this thread or in a worker.
+type jsCaller interface {
+	// call calls the adapter function name, returning anything it throws as an error.
+	call(name string, args ...interface{}) (js.Value, error)
+	// helper calls the JS helper function name, returning anything it throws as an error.
+	helper(name string, args ...interface{}) (js.Value, error)
+}
+
+// jsInterrupter is a jsCaller which can interrupt the calls it is running on a statement.
+type jsInterrupter interface {
+	interrupt(stmt js.Value)
+}
+
+// call calls the adapter function name, returning anything it throws as an error.
+func (b *jsBackend) call(name string, args ...interface{}) (js.Value, error) {
+	return jsTryCatch(func() js.Value {
+		return b.adapter.Call(name, args...)
+	})
+}
+
+// helper calls the JS helper function name, returning anything it throws as an error.
+func (b *jsBackend) helper(name string, args ...interface{}) (js.Value, error) {
+	return jsTryCatch(func() js.Value {
+		return b.helpers.Call(name, args...)
+	})
+}
+
+func (b *jsBackend) Open(name string) (BackendDB, error) {
+	return openJS(b, name)
+}
+
+func (b *jsBackend) OpenVFS(name, vfs string) (BackendDB, error) {
+	if b.adapter.Get("openVFS").Type() != js.TypeFunction {
+		return nil, fmt.Errorf("open %q: the backend doesn't support choosing a VFS", name)
+	}
+	db, err := b.call("openVFS", name, vfs)
+	if err != nil {
+		return nil, fmt.Errorf("open %q with VFS %q: %s", name, vfs, err)
+	}
+	return &jsBackendDB{b: b, js: db}, nil
+}
+
+// adoptJSDB returns a BackendDB for jsDB, a database object of the SQLite build of backend
+// opened in JS, or nil if backend can't take over databases opened outside of it.
+func adoptJSDB(backend Backend, jsDB js.Value) BackendDB {
+	b, ok := backend.(*jsBackend)
+	if !ok {
+		return nil
+	}
+	return &jsBackendDB{b: b, js: jsDB}
+}
+
+// openJS opens the database called name with the adapter c calls.
+func openJS(c jsCaller, name string) (BackendDB, error) {
+	db, err := c.call("open", name)
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %s", name, err)
+	}
+	return &jsBackendDB{b: c, js: db}, nil
+}
+
+type jsBackendDB struct {
+	b  jsCaller
+	js js.Value
+
+	noStatus int32 // set if the build doesn't expose sqlite3_stmt_status; accessed atomically
+}
+
+func (d *jsBackendDB) Prepare(query string) (BackendStmt, string, error) {
+	// SQLite builds disagree on how to report SQL without statements, most throw
+	if isBlankSQL(query) {
+		return nil, "", nil
+	}
+	res, err := d.b.call("prepare", d.js, query)
+	if err != nil {
+		return nil, "", err
+	}
+	return &jsBackendStmt{
+		db:  d,
+		js:  res.Get("stmt"),
+		sql: res.Get("sql").String(),
+	}, res.Get("tail").String(), nil
+}
+
+func (d *jsBackendDB) Changes() (int64, error) {
+	res, err := d.b.call("changes", d.js)
+	if err != nil {
+		return 0, err
+	}
+	return int64(res.Float()), nil
+}
+
+func (d *jsBackendDB) LastInsertRowID() (int64, error) {
+	res, err := d.b.call("lastInsertRowid", d.js)
+	if err != nil {
+		return 0, err
+	}
+	return int64(res.Float()), nil
+}
+
+func (d *jsBackendDB) Export() ([]byte, error) {
+	res, err := d.b.call("export", d.js)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, res.Length())
+	js.CopyBytesToGo(data, res)
+	return data, nil
+}
+
+func (d *jsBackendDB) Close() error {
+	_, err := d.b.call("close", d.js)
+	return err
+}
+
+func (d *jsBackendDB) JS() js.Value {
+	return d.js
+}
+
+func (d *jsBackendDB) openImage(data []byte) (BackendDB, error) {
+	buf := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(buf, data)
+	db, err := d.b.call("openImage", buf)
+	if err != nil {
+		return nil, fmt.Errorf("open snapshot: %s", err)
+	}
+	return &jsBackendDB{b: d.b, js: db}, nil
+}
+
+func (d *jsBackendDB) backup(dst BackendDB) (backupStepper, error) {
+	jsDst, ok := dst.(*jsBackendDB)
+	if !ok || jsDst.b != d.b {
+		// sqlite3_backup only works within a single SQLite build
+		return nil, nil
+	}
+	res, err := d.b.call("backupInit", jsDst.js, d.js)
+	if err != nil || res.IsNull() {
+		return nil, err
+	}
+	return &jsBackup{dst: jsDst, js: res}, nil
+}
+
+// jsBackup is a sqlite3_backup in progress.
+type jsBackup struct {
+	dst *jsBackendDB
+	js  js.Value
+}
+
+func (b *jsBackup) step(pages int) (done bool, remaining, total int, err error) {
+	res, err := b.dst.b.call("backupStep", b.dst.js, b.js, pages)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return res.Index(0).Bool(), res.Index(1).Int(), res.Index(2).Int(), nil
+}
+
+func (b *jsBackup) finish() error {
+	_, err := b.dst.b.call("backupFinish", b.dst.js, b.js)
+	return err
+}
+
+func (d *jsBackendDB) memoryStats() (used, highwater, heap int64) {
+	res, err := d.b.call("memory")
+	if err != nil || res.Type() != js.TypeObject {
+		return -1, -1, -1
+	}
+	read := func(name string) int64 {
+		if v := res.Get(name); v.Type() == js.TypeNumber {
+			return int64(v.Float())
+		}
+		return -1
+	}
+	return read("used"), read("highwater"), read("heap")
+}
+
+type jsBackendStmt struct {
+	db  *jsBackendDB
+	js  js.Value
+	sql string
+}
+
+func (s *jsBackendStmt) interrupt() {
+	if i, ok := s.db.b.(jsInterrupter); ok {
+		i.interrupt(s.js)
+	}
+}
+
+func (s *jsBackendStmt) SQL() string {
+	return s.sql
+}
+
+func (s *jsBackendStmt) NumParams() int {
+	if res, err := s.db.b.call("paramCount", s.js); err == nil && res.Type() == js.TypeNumber && res.Int() >= 0 {
+		return res.Int()
+	}
+	return countParams(s.sql)
+}
+
+func (s *jsBackendStmt) Bind(args []driver.Value) error {
+	_, err := s.db.b.call("bind", s.js, toJSArgs(args))
+	return err
+}
+
+func (s *jsBackendStmt) Step() (bool, error) {
+	res, err := s.db.b.call("step", s.js)
+	if err != nil {
+		return false, err
+	}
+	return res.Truthy(), nil
+}
+
+func (s *jsBackendStmt) ColumnNames() ([]string, error) {
+	res, err := s.db.b.call("columnNames", s.js)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, res.Length())
+	for i := range names {
+		names[i] = res.Index(i).String()
+	}
+	return names, nil
+}
+
+func (s *jsBackendStmt) Row(dest []driver.Value) error {
+	res, err := s.db.b.helper("packRow", s.js)
+	if err != nil {
+		return err
+	}
+	batch, _ := readRowBatch(res)
+	return batch.next(dest)
+}
+
+func (s *jsBackendStmt) Reset() error {
+	_, err := s.db.b.call("reset", s.js)
+	return err
+}
+
+func (s *jsBackendStmt) Finalize() error {
+	_, err := s.db.b.call("finalize", s.js)
+	return err
+}
+
+func (s *jsBackendStmt) JS() js.Value {
+	return s.js
+}
+
+func (s *jsBackendStmt) exec(args []driver.Value) (changes, id int64, err error) {
+	res, err := s.db.b.helper("execStatement", s.db.js, s.js, toJSArgs(args))
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(res.Get("changes").Float()), int64(res.Get("id").Float()), nil
+}
+
+func (s *jsBackendStmt) bulkExec(rows [][]driver.Value) (changes, id int64, err error) {
+	jsRows := make([]interface{}, len(rows))
+	for i, row := range rows {
+		jsRows[i] = toJSArgs(row)
+	}
+	res, err := s.db.b.helper("bulkExec", s.db.js, s.js, jsRows)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(res.Get("changes").Float()), int64(res.Get("id").Float()), nil
+}
+
+func (s *jsBackendStmt) fetchRows(max int) (rowBatch, bool, error) {
+	res, err := s.db.b.helper("fetchRows", s.js, max)
+	if err != nil {
+		return rowBatch{}, false, err
+	}
+	batch, more := readRowBatch(res)
+	return batch, more, nil
+}
+
+func (s *jsBackendStmt) freed() bool {
+	res, err := s.db.b.call("freed", s.js)
+	return err == nil && res.Truthy()
+}
+
+func (s *jsBackendStmt) status() (stmtStatus, bool) {
+	if atomic.LoadInt32(&s.db.noStatus) != 0 {
+		return stmtStatus{}, false
+	}
+	res, err := s.db.b.call("stmtStatus", s.js)
+	if err != nil || res.Type() != js.TypeObject {
+		// don't ask again, which takes a round trip for workers
+		atomic.StoreInt32(&s.db.noStatus, 1)
+		return stmtStatus{}, false
+	}
+	return stmtStatus{
+		fullScanSteps: int64(res.Index(0).Float()),
+		sorts:         int64(res.Index(1).Float()),
+		autoIndexes:   int64(res.Index(2).Float()),
+	}, true
+}
+
+func (s *jsBackendStmt) columnTypes(hasRow bool) ([]columnType, error) {
+	res, err := s.db.b.helper("columnTypes", s.db.js, s.js, hasRow)
+	if err != nil {
+		return nil, err
+	}
+	return readColumnTypes(res), nil
+}
+
+// readColumnTypes reads the column types described by the columnTypes JS helper.
+func readColumnTypes(res js.Value) []columnType {
+	types := make([]columnType, res.Length())
+	for i := range types {
+		col := res.Index(i)
+		if decl := col.Get("decltype"); decl.Type() == js.TypeString {
+			types[i].declType = decl.String()
+		}
+		if storage := col.Get("storage"); storage.Type() == js.TypeString {
+			types[i].storage = storage.String()
+		}
+		if notNull := col.Get("notnull"); notNull.Type() == js.TypeBoolean {
+			types[i].notNull = notNull.Bool()
+			types[i].notNullOK = true
+		}
+	}
+	return types
+}
+
+// toJSArgs converts args to the values bound to placeholders.
+func toJSArgs(args []driver.Value) []interface{} {
+	jsArgs := make([]interface{}, len(args))
+	for i, v := range args {
+		jsArgs[i] = toJSValue(v)
+	}
+	return jsArgs
+}
+
+// toJSValue converts v to the value bound to a placeholder: a Uint8Array for []byte.
+func toJSValue(v driver.Value) interface{} {
+	if bval, ok := v.([]byte); ok {
+		dst := js.Global().Get("Uint8Array").New(len(bval))
+		js.CopyBytesToJS(dst, bval)
+		return dst
+	}
+	return js.ValueOf(v)
+}
@@ -0,0 +1,168 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import "syscall/js"
+
+// oo1AdapterSource adapts the oo1 API of the official SQLite WASM build
+// (https://sqlite.org/wasm/doc/trunk/api-oo1.md) for jsBackend, using its C API where oo1 has
+// no equivalent.
+const oo1AdapterSource = `
+var capi = SQL.capi;
+
+// toNumber converts a 64-bit integer, which the build returns as a BigInt if it supports them.
+function toNumber(v) {
+	return typeof v === "bigint" ? Number(v) : v;
+}
+
+return {
+	open: function(name) {
+		return new SQL.oo1.DB(name, "c");
+	},
+	openVFS: function(name, vfs) {
+		if (vfs === "opfs") {
+			// only installed when the build runs in a dedicated worker with OPFS support
+			if (typeof SQL.oo1.OpfsDb !== "function") {
+				throw new Error("the OPFS VFS isn't available, sqlite-wasm must run in a dedicated worker of a browser supporting OPFS");
+			}
+			return new SQL.oo1.OpfsDb(name, "c");
+		}
+		if (!capi.sqlite3_vfs_find(vfs)) {
+			throw new Error("no such VFS");
+		}
+		return new SQL.oo1.DB({filename: name, flags: "c", vfs: vfs});
+	},
+	openImage: function(data) {
+		var db = new SQL.oo1.DB(":memory:", "c");
+		var p = SQL.wasm.allocFromTypedArray(data);
+		var rc = capi.sqlite3_deserialize(db.pointer, "main", p, data.byteLength, data.byteLength,
+			capi.SQLITE_DESERIALIZE_FREEONCLOSE | capi.SQLITE_DESERIALIZE_RESIZEABLE);
+		if (rc !== capi.SQLITE_OK) {
+			db.close();
+			throw new Error("couldn't deserialize the database: " + capi.sqlite3_js_rc_str(rc));
+		}
+		return db;
+	},
+	prepare: function(db, sql) {
+		var stmt = db.prepare(sql);
+		return prepared(stmt, capi.sqlite3_sql(stmt.pointer), sql);
+	},
+	paramCount: function(stmt) {
+		return stmt.parameterCount;
+	},
+	bind: function(stmt, args) {
+		// oo1 throws when binding to a statement without placeholders, even nothing
+		if (args.length !== 0) {
+			stmt.bind(args);
+		}
+	},
+	step: function(stmt) {
+		return stmt.step();
+	},
+	get: function(stmt) {
+		return stmt.get([]);
+	},
+	columnNames: function(stmt) {
+		return stmt.getColumnNames([]);
+	},
+	reset: function(stmt) {
+		try {
+			stmt.reset(true);
+		} catch (e) {
+			// oo1 rethrows the error of the last step, which has been reported already
+		}
+	},
+	finalize: function(stmt) {
+		stmt.finalize();
+	},
+	exec: function(db, sql) {
+		db.exec(sql);
+	},
+	selectRow: function(db, sql, params) {
+		var row = db.selectArray(sql, params);
+		return row === undefined ? null : row;
+	},
+	changes: function(db) {
+		return toNumber(capi.sqlite3_changes(db.pointer));
+	},
+	lastInsertRowid: function(db) {
+		return toNumber(capi.sqlite3_last_insert_rowid(db.pointer));
+	},
+	export: function(db) {
+		return capi.sqlite3_js_db_export(db.pointer);
+	},
+	close: function(db) {
+		db.close();
+	},
+	columnString: function(stmt, fn, i) {
+		var f = capi["sqlite3_column_" + fn];
+		return typeof f === "function" ? f(stmt.pointer, i) : null;
+	},
+	columnType: function(stmt, i) {
+		return capi.sqlite3_column_type(stmt.pointer, i);
+	},
+	tableColumnMetadata: function(db, schema, table, column) {
+		// reading the out parameters takes wasm-level allocation, table_info is cheap enough
+		return null;
+	},
+	backupInit: function(dst, src) {
+		if (typeof capi.sqlite3_backup_init !== "function") {
+			return null;
+		}
+		var b = capi.sqlite3_backup_init(dst.pointer, "main", src.pointer, "main");
+		if (!b) {
+			throw new Error(capi.sqlite3_errmsg(dst.pointer));
+		}
+		return b;
+	},
+	backupStep: function(dst, b, pages) {
+		var rc = capi.sqlite3_backup_step(b, pages);
+		if (rc !== capi.SQLITE_OK && rc !== capi.SQLITE_BUSY && rc !== capi.SQLITE_LOCKED && rc !== capi.SQLITE_DONE) {
+			throw new Error(capi.sqlite3_errmsg(dst.pointer));
+		}
+		return [rc === capi.SQLITE_DONE, capi.sqlite3_backup_remaining(b), capi.sqlite3_backup_pagecount(b)];
+	},
+	backupFinish: function(dst, b) {
+		if (capi.sqlite3_backup_finish(b) !== capi.SQLITE_OK) {
+			throw new Error(capi.sqlite3_errmsg(dst.pointer));
+		}
+	},
+	memory: function() {
+		var used = capi.sqlite3_memory_used;
+		var highwater = capi.sqlite3_memory_highwater;
+		var mem = SQL.wasm && SQL.wasm.memory;
+		return {
+			used: typeof used === "function" ? toNumber(used()) : null,
+			highwater: typeof highwater === "function" ? toNumber(highwater(0)) : null,
+			heap: mem ? mem.buffer.byteLength : null,
+		};
+	},
+	stmtStatus: function(stmt) {
+		var f = capi.sqlite3_stmt_status;
+		if (typeof f !== "function") {
+			return null;
+		}
+		// FULLSCAN_STEP, SORT and AUTOINDEX, reset as they are read
+		return [f(stmt.pointer, 1, 1), f(stmt.pointer, 2, 1), f(stmt.pointer, 3, 1)];
+	},
+	freed: function(stmt) {
+		// export serializes without touching statements, so only finalize frees them
+		return !stmt.pointer;
+	},
+};
+`
+
+// NewOO1Backend returns a Backend for the official SQLite WASM build (@sqlite.org/sqlite-wasm),
+// given the module returned by its init function:
+//
+//	const sqlite3 = await sqlite3InitModule({ ... })
+//
+// Databases are opened with the oo1 API, so a name is a path in the default VFS of the build, or
+// in the VFS set with the vfs DSN parameter. vfs=opfs opens durable databases on the Origin
+// Private File System, which sqlite-wasm only supports in a dedicated worker: either run the Go
+// WASM in that worker, or run the build in a worker of its own with StartOO1Worker and
+// NewWorkerBackend. Each transaction is written through to OPFS as it commits.
+func NewOO1Backend(sqlite3 js.Value) Backend {
+	return newJSBackend(sqlite3, oo1AdapterSource)
+}
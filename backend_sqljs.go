@@ -0,0 +1,247 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import "syscall/js"
+
+// sqlJSAdapterSource adapts the sql.js object model (https://sql-js.github.io/sql.js/documentation/)
+// for jsBackend. sql.js only exports the subset of the C API it uses itself, so the adapter probes
+// for the C functions and wasm-level pointers it uses and falls back to SQL where they are missing.
+const sqlJSAdapterSource = `
+// cFunc returns the C function sqlite3_<name> if the module exports it, or null.
+function cFunc(name) {
+	var f = SQL["_sqlite3_" + name];
+	return typeof f === "function" ? f : null;
+}
+
+// pointer returns the sqlite3_stmt* of a Statement or the sqlite3* of a Database, or 0 if the
+// build renamed the field.
+function pointer(v, field) {
+	var p = v[field];
+	return typeof p === "number" ? p : 0;
+}
+
+// cString calls the C function sqlite3_<name> and converts the returned char* to a string, or
+// returns null if the function or the pointer isn't reachable.
+function cString(name, ptr, i) {
+	var f = cFunc(name);
+	if (f === null || typeof SQL.UTF8ToString !== "function" || ptr === 0) {
+		return null;
+	}
+	var res = f(ptr, i);
+	return res ? SQL.UTF8ToString(res) : null;
+}
+
+// int64 converts the result of a C function returning a 64-bit integer to a number, or returns
+// null if the build legalized it to 32 bits and the high bits aren't reachable.
+function int64(v) {
+	if (typeof v === "bigint") {
+		return Number(v);
+	}
+	if (typeof v === "number" && typeof SQL.getTempRet0 === "function") {
+		return SQL.getTempRet0() * 4294967296 + (v >>> 0);
+	}
+	return null;
+}
+
+// errmsg returns the message of the last error on db.
+function errmsg(db) {
+	return cString("errmsg", pointer(db, "db")) || "unknown error";
+}
+
+function selectRow(db, sql, params) {
+	var stmt = db.prepare(sql);
+	try {
+		stmt.bind(params);
+		return stmt.step() ? stmt.get() : null;
+	} finally {
+		stmt.free();
+	}
+}
+
+// rowidStmts holds a "SELECT last_insert_rowid()" statement per database, for builds which
+// don't export sqlite3_last_insert_rowid.
+var rowidStmts = new WeakMap();
+
+function lastInsertRowid(db) {
+	var f = cFunc("last_insert_rowid");
+	if (f !== null && pointer(db, "db") !== 0) {
+		var id = int64(f(db.db));
+		if (id !== null) {
+			return id;
+		}
+	}
+	var stmt = rowidStmts.get(db);
+	var row;
+	try {
+		if (!stmt) {
+			throw new Error("not prepared");
+		}
+		stmt.step();
+		row = stmt.get();
+	} catch (e) {
+		// the statement is freed along with all others by Database.export()
+		stmt = db.prepare("SELECT last_insert_rowid()");
+		rowidStmts.set(db, stmt);
+		stmt.step();
+		row = stmt.get();
+	}
+	stmt.reset();
+	return row[0];
+}
+
+function tableColumnMetadata(db, schema, table, column) {
+	var f = cFunc("table_column_metadata");
+	var toC = SQL.stringToUTF8OnStack || SQL.allocateUTF8OnStack;
+	if (f === null || typeof toC !== "function" || pointer(db, "db") === 0 ||
+		typeof SQL.stackSave !== "function" || typeof SQL.stackAlloc !== "function" || typeof SQL.getValue !== "function") {
+		return null;
+	}
+	var sp = SQL.stackSave();
+	try {
+		var out = SQL.stackAlloc(20);
+		var rc = f(db.db, schema === null ? 0 : toC(schema), toC(table), toC(column), out, out + 4, out + 8, out + 12, out + 16);
+		if (rc !== 0) {
+			return null;
+		}
+		var decl = SQL.getValue(out, "i32");
+		return {
+			decltype: decl ? SQL.UTF8ToString(decl) : "",
+			notnull: SQL.getValue(out + 8, "i32") !== 0,
+		};
+	} finally {
+		SQL.stackRestore(sp);
+	}
+}
+
+return {
+	open: function(name) {
+		// the name only identifies the database to the driver: sql.js reads the argument of
+		// Database as the contents of the database file
+		return new SQL.Database();
+	},
+	openImage: function(data) {
+		return new SQL.Database(data);
+	},
+	prepare: function(db, sql) {
+		var stmt = db.prepare(sql);
+		return prepared(stmt, stmt.getSQL(), sql);
+	},
+	paramCount: function(stmt) {
+		var f = cFunc("bind_parameter_count");
+		var p = pointer(stmt, "stmt");
+		return f !== null && p !== 0 ? f(p) : -1;
+	},
+	bind: function(stmt, args) {
+		if (!stmt.bind(args)) {
+			throw new Error("couldn't bind stmt");
+		}
+	},
+	step: function(stmt) {
+		return stmt.step();
+	},
+	get: function(stmt) {
+		return stmt.get();
+	},
+	columnNames: function(stmt) {
+		return stmt.getColumnNames();
+	},
+	reset: function(stmt) {
+		stmt.reset();
+	},
+	finalize: function(stmt) {
+		// statements already freed, e.g. by Database.export(), are freed again without error
+		if (!stmt.free()) {
+			throw new Error("couldn't close stmt");
+		}
+	},
+	exec: function(db, sql) {
+		db.exec(sql);
+	},
+	selectRow: selectRow,
+	changes: function(db) {
+		return db.getRowsModified();
+	},
+	lastInsertRowid: lastInsertRowid,
+	export: function(db) {
+		return db.export();
+	},
+	close: function(db) {
+		db.close();
+	},
+	columnString: function(stmt, fn, i) {
+		return cString("column_" + fn, pointer(stmt, "stmt"), i);
+	},
+	columnType: function(stmt, i) {
+		var f = cFunc("column_type");
+		var p = pointer(stmt, "stmt");
+		return f !== null && p !== 0 ? f(p, i) : -1;
+	},
+	tableColumnMetadata: tableColumnMetadata,
+	backupInit: function(dst, src) {
+		var init = cFunc("backup_init");
+		var toC = SQL.stringToUTF8OnStack || SQL.allocateUTF8OnStack;
+		if (init === null || cFunc("backup_step") === null || cFunc("backup_finish") === null ||
+			cFunc("backup_remaining") === null || cFunc("backup_pagecount") === null ||
+			typeof toC !== "function" || typeof SQL.stackSave !== "function" ||
+			pointer(dst, "db") === 0 || pointer(src, "db") === 0) {
+			return null;
+		}
+		var sp = SQL.stackSave();
+		try {
+			var b = init(dst.db, toC("main"), src.db, toC("main"));
+			if (b === 0) {
+				throw new Error(errmsg(dst));
+			}
+			return b;
+		} finally {
+			SQL.stackRestore(sp);
+		}
+	},
+	backupStep: function(dst, b, pages) {
+		var rc = cFunc("backup_step")(b, pages);
+		// SQLITE_OK, SQLITE_BUSY and SQLITE_LOCKED leave pages to copy, SQLITE_DONE doesn't
+		if (rc !== 0 && rc !== 5 && rc !== 6 && rc !== 101) {
+			throw new Error(errmsg(dst));
+		}
+		return [rc === 101, cFunc("backup_remaining")(b), cFunc("backup_pagecount")(b)];
+	},
+	backupFinish: function(dst, b) {
+		if (cFunc("backup_finish")(b) !== 0) {
+			throw new Error(errmsg(dst));
+		}
+	},
+	memory: function() {
+		var used = cFunc("memory_used");
+		var highwater = cFunc("memory_highwater");
+		return {
+			used: used !== null ? int64(used()) : null,
+			highwater: highwater !== null ? int64(highwater(0)) : null,
+			heap: SQL.HEAP8 ? SQL.HEAP8.buffer.byteLength : null,
+		};
+	},
+	stmtStatus: function(stmt) {
+		var f = cFunc("stmt_status");
+		if (f === null) {
+			return null;
+		}
+		// the pointer is 0 once the statement is freed, e.g. by Database.export()
+		var p = pointer(stmt, "stmt");
+		// FULLSCAN_STEP, SORT and AUTOINDEX, reset as they are read
+		return p !== 0 ? [f(p, 1, 1), f(p, 2, 1), f(p, 3, 1)] : [0, 0, 0];
+	},
+	freed: function(stmt) {
+		return pointer(stmt, "stmt") === 0;
+	},
+};
+`
+
+// NewSQLJSBackend returns a Backend for sql.js, given the module returned by initSqlJs:
+//
+//	const SQL = await initSqlJs({ ... })
+//
+// This is the backend used by default, with the module in the _go_sqlite global.
+func NewSQLJSBackend(module js.Value) Backend {
+	return newJSBackend(module, sqlJSAdapterSource)
+}
@@ -0,0 +1,351 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall/js"
+)
+
+// workerLoopSource is the message loop of the worker script, run after initModule, makeAdapter
+// and makeHelpers are defined. Requests are {id, fn, name, args}, calling the adapter function
+// (fn "call") or JS helper (fn "helper") called name, and replies are {id, ok, result} or
+// {id, ok, error}. Databases and statements stay in the worker, and are referred to by
+// {handle} objects. Requests are queued and run one per task, so that an interrupt request
+// {fn "interrupt", args [stmt]} fails the requests queued for stmt.
+const workerLoopSource = `
+var A = null, H = null, initError = null;
+var handles = new Map(), nextHandle = 1;
+var queue = [], scheduled = false;
+var tick = new MessageChannel();
+
+function toHandle(v) {
+	var h = nextHandle++;
+	handles.set(h, v);
+	return {handle: h};
+}
+
+function isHandle(arg) {
+	return arg !== null && typeof arg === "object" && typeof arg.handle === "number";
+}
+
+function resolve(arg) {
+	if (!isHandle(arg)) {
+		return arg;
+	}
+	if (!handles.has(arg.handle)) {
+		throw new Error("unknown handle " + arg.handle);
+	}
+	return handles.get(arg.handle);
+}
+
+function run(m) {
+	if (initError !== null) {
+		throw initError;
+	}
+	if (m.interrupted) {
+		throw new Error("interrupted");
+	}
+	var fns = m.fn === "helper" ? H : A;
+	if (typeof fns[m.name] !== "function") {
+		throw new Error("no such function: " + m.name);
+	}
+	var res = fns[m.name].apply(null, m.args.map(resolve));
+	switch (m.name) {
+	case "open":
+	case "openVFS":
+	case "openImage":
+		return toHandle(res);
+	case "prepare":
+		res.stmt = toHandle(res.stmt);
+		return res;
+	case "finalize":
+	case "close":
+		handles.delete(m.args[0].handle);
+	}
+	return res;
+}
+
+function reply(m) {
+	var msg;
+	try {
+		msg = {id: m.id, ok: true, result: run(m)};
+	} catch (e) {
+		msg = {id: m.id, ok: false, error: e};
+	}
+	try {
+		self.postMessage(msg);
+	} catch (e) {
+		// e.g. a result which can't be cloned
+		self.postMessage({id: m.id, ok: false, error: String(e && e.message !== undefined ? e.message : e)});
+	}
+}
+
+function schedule() {
+	if (!scheduled && queue.length !== 0 && (A !== null || initError !== null)) {
+		scheduled = true;
+		tick.port2.postMessage(null);
+	}
+}
+
+tick.port1.onmessage = function() {
+	scheduled = false;
+	reply(queue.shift());
+	schedule();
+};
+
+self.addEventListener("message", function(e) {
+	var m = e.data;
+	if (m.fn === "interrupt") {
+		var stmt = m.args[0].handle;
+		queue.forEach(function(q) {
+			if (q.args.some(function(arg) { return isHandle(arg) && arg.handle === stmt; })) {
+				q.interrupted = true;
+			}
+		});
+		return;
+	}
+	queue.push(m);
+	schedule();
+});
+
+initModule().then(function(SQL) {
+	A = makeAdapter(SQL);
+	H = makeHelpers(A);
+	schedule();
+}, function(e) {
+	initError = e;
+	schedule();
+});
+`
+
+// WorkerScript returns the source of a dedicated worker script running sql.js for
+// NewWorkerBackend. sqlJSURL is the absolute URL of sql-wasm.js, which sql-wasm.wasm is loaded
+// from alongside. If it is empty, initSqlJs must already be defined in the worker scope.
+func WorkerScript(sqlJSURL string) string {
+	return workerScript(sqlJSURL, "initSqlJs", sqlJSAdapterSource)
+}
+
+// OO1WorkerScript returns the source of a dedicated worker script running the official SQLite
+// WASM build for NewWorkerBackend, with the adapter of NewOO1Backend. sqlite3URL is the absolute
+// URL of sqlite3.js, which sqlite3.wasm is loaded from alongside. If it is empty,
+// sqlite3InitModule must already be defined in the worker scope.
+//
+// sqlite-wasm only installs its OPFS VFS in a dedicated worker, so this is how the Go WASM opens
+// databases with vfs=opfs while running on another thread.
+func OO1WorkerScript(sqlite3URL string) string {
+	return workerScript(sqlite3URL, "sqlite3InitModule", oo1AdapterSource)
+}
+
+// workerScript returns the source of a worker script loading the script at url, if set, and
+// calling the init function called initName, which resolves to the module adapterSource adapts.
+func workerScript(url, initName, adapterSource string) string {
+	load, config := "", "{}"
+	if url != "" {
+		u, _ := json.Marshal(url)
+		load = "importScripts(" + string(u) + ");\n"
+		config = "{locateFile: function(file) { return new URL(file, " + string(u) + ").href; }}"
+	}
+	return load +
+		"var initModule = function() { return self." + initName + "(" + config + "); };\n" +
+		"var makeAdapter = function(SQL) {" + jsAdapterPrelude + adapterSource + "};\n" +
+		"var makeHelpers = function(A) {" + jsHelpersSource + "};\n" +
+		workerLoopSource
+}
+
+// StartWorker starts a dedicated worker running WorkerScript(sqlJSURL).
+func StartWorker(sqlJSURL string) (js.Value, error) {
+	return startWorker(WorkerScript(sqlJSURL))
+}
+
+// StartOO1Worker starts a dedicated worker running OO1WorkerScript(sqlite3URL).
+func StartOO1Worker(sqlite3URL string) (js.Value, error) {
+	return startWorker(OO1WorkerScript(sqlite3URL))
+}
+
+// startWorker starts a dedicated worker running script.
+func startWorker(script string) (js.Value, error) {
+	return jsTryCatch(func() js.Value {
+		blob := js.Global().Get("Blob").New([]interface{}{script}, map[string]interface{}{"type": "text/javascript"})
+		return js.Global().Get("Worker").New(js.Global().Get("URL").Call("createObjectURL", blob))
+	})
+}
+
+// workerBackend is a jsCaller passing its calls to a worker running WorkerScript.
+type workerBackend struct {
+	worker         js.Value
+	onMessage      js.Func
+	onError        js.Func
+	onMessageError js.Func
+	mu             sync.Mutex
+	nextID         int
+	pending        map[int]workerRequest
+	err            error // set once the worker script failed, failing all later requests
+}
+
+// workerRequest is a request waiting for its reply.
+type workerRequest struct {
+	ch      chan workerReply
+	handles []int // of the databases and statements in its args
+}
+
+type workerReply struct {
+	result js.Value
+	err    error
+}
+
+// NewWorkerBackend returns a Backend running SQLite in a worker, started with StartWorker or
+// StartOO1Worker or otherwise running WorkerScript or OO1WorkerScript, so that long queries
+// don't block the thread of the Go WASM. It is a VFSBackend, though only the official build
+// has VFSes to choose from.
+// Calls block the calling goroutine until the worker replies, while the JS event loop carries
+// on. They must not be made from a js.Func, which can't block.
+//
+// Canceling the context of an exec or of reading rows returns at once and fails the requests
+// queued in the worker for the same statement, leaving other connections to the database alone.
+// It doesn't stop a statement the worker is already running, which carries on until it
+// finishes, and its reply is dropped.
+// If the worker script throws, or a reply can't be deserialized, the calls waiting for a reply
+// fail. After an error thrown by the worker script all later calls fail too. A worker which is
+// terminated or never replies isn't noticed, except by canceling contexts.
+func NewWorkerBackend(worker js.Value) Backend {
+	b := &workerBackend{
+		worker:  worker,
+		pending: make(map[int]workerRequest),
+	}
+	b.onMessage = js.FuncOf(b.receive)
+	b.onError = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		msg := "uncaught error"
+		if len(args) > 0 && args[0].Type() == js.TypeObject && args[0].Get("message").Type() == js.TypeString {
+			msg = args[0].Get("message").String()
+		}
+		b.fail(fmt.Errorf("worker: %s", msg), true)
+		return nil
+	})
+	b.onMessageError = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		b.fail(errors.New("worker: a reply couldn't be deserialized"), false)
+		return nil
+	})
+	worker.Call("addEventListener", "message", b.onMessage)
+	worker.Call("addEventListener", "error", b.onError)
+	worker.Call("addEventListener", "messageerror", b.onMessageError)
+	return b
+}
+
+// fail fails the requests waiting for a reply with err, and if broken all later ones.
+func (b *workerBackend) fail(err error, broken bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if broken && b.err == nil {
+		b.err = err
+	}
+	for id, req := range b.pending {
+		req.ch <- workerReply{err: err}
+		delete(b.pending, id)
+	}
+}
+
+func (b *workerBackend) Open(name string) (BackendDB, error) {
+	return openJS(b, name)
+}
+
+func (b *workerBackend) OpenVFS(name, vfs string) (BackendDB, error) {
+	db, err := b.call("openVFS", name, vfs)
+	if err != nil {
+		return nil, fmt.Errorf("open %q with VFS %q: %s", name, vfs, err)
+	}
+	return &jsBackendDB{b: b, js: db}, nil
+}
+
+func (b *workerBackend) call(name string, args ...interface{}) (js.Value, error) {
+	return b.request("call", name, args)
+}
+
+func (b *workerBackend) helper(name string, args ...interface{}) (js.Value, error) {
+	return b.request("helper", name, args)
+}
+
+// interrupt fails the requests queued in the worker for stmt, and stops waiting for the replies
+// to the requests sent for it.
+func (b *workerBackend) interrupt(stmt js.Value) {
+	_, _ = jsTryCatch(func() js.Value {
+		return b.worker.Call("postMessage", map[string]interface{}{
+			"fn":   "interrupt",
+			"args": []interface{}{stmt},
+		})
+	})
+	h := stmt.Get("handle").Int()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, req := range b.pending {
+		for _, rh := range req.handles {
+			if rh == h {
+				req.ch <- workerReply{err: errors.New("interrupted")}
+				delete(b.pending, id)
+				break
+			}
+		}
+	}
+}
+
+// request posts a request to the worker and waits for its reply.
+func (b *workerBackend) request(fn, name string, args []interface{}) (js.Value, error) {
+	req := workerRequest{ch: make(chan workerReply, 1)}
+	for _, arg := range args {
+		if h, ok := arg.(js.Value); ok && h.Type() == js.TypeObject && h.Get("handle").Type() == js.TypeNumber {
+			req.handles = append(req.handles, h.Get("handle").Int())
+		}
+	}
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return js.Undefined(), b.err
+	}
+	b.nextID++
+	id := b.nextID
+	b.pending[id] = req
+	b.mu.Unlock()
+	_, err := jsTryCatch(func() js.Value {
+		return b.worker.Call("postMessage", map[string]interface{}{
+			"id":   id,
+			"fn":   fn,
+			"name": name,
+			"args": args,
+		})
+	})
+	if err != nil {
+		b.mu.Lock()
+		delete(b.pending, id)
+		b.mu.Unlock()
+		return js.Undefined(), err
+	}
+	reply := <-req.ch
+	return reply.result, reply.err
+}
+
+// receive handles a reply from the worker, waking up the goroutine waiting for it.
+func (b *workerBackend) receive(this js.Value, args []js.Value) interface{} {
+	data := args[0].Get("data")
+	if data.Type() != js.TypeObject || data.Get("id").Type() != js.TypeNumber {
+		return nil
+	}
+	id := data.Get("id").Int()
+	b.mu.Lock()
+	req, ok := b.pending[id]
+	delete(b.pending, id)
+	b.mu.Unlock()
+	if !ok {
+		// e.g. the reply to an interrupted request
+		return nil
+	}
+	if data.Get("ok").Bool() {
+		req.ch <- workerReply{result: data.Get("result")}
+	} else {
+		req.ch <- workerReply{err: jsException(data.Get("error"))}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// copyBatchSize is the number of rows copied at once by backups without sqlite3_backup.
+const copyBatchSize = 256
+
+// Backup copies the database opened with srcDSN by the default driver into the database dstDSN
+// names, replacing its contents, e.g. to snapshot a live database before a risky migration and
+// to restore it if that fails. See SqliteJsDriver.Backup.
+func Backup(ctx context.Context, srcDSN, dstDSN string, pagesPerStep int, progress func(remaining, total int)) error {
+	return (&SqliteJsDriver{}).Backup(ctx, srcDSN, dstDSN, pagesPerStep, progress)
+}
+
+// Backup copies the database opened with srcDSN by the driver into the database dstDSN names,
+// which is opened if it isn't open yet, replacing its contents.
+//
+// If the SQLite build exposes sqlite3_backup, pagesPerStep pages are copied at a time, or all of
+// them if pagesPerStep <= 0, and the JS event loop runs between steps so that the page stays
+// responsive. progress, if set, is called after each step with the number of pages left to copy
+// out of the total. Writes to the source between steps are carried over to the backup.
+//
+// Otherwise the tables are copied row by row in a single transaction on dstDSN, while holding a
+// read transaction on srcDSN. progress is only called before and after the copy, and rowids of
+// tables without an INTEGER PRIMARY KEY may be renumbered, as by VACUUM.
+func (d *SqliteJsDriver) Backup(ctx context.Context, srcDSN, dstDSN string, pagesPerStep int, progress func(remaining, total int)) error {
+	src, _, err := d.database(srcDSN, false)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return fmt.Errorf("database %q isn't open", srcDSN)
+	}
+	dst, _, err := d.database(dstDSN, true)
+	if err != nil {
+		return err
+	}
+	if src == dst {
+		return fmt.Errorf("can't back up %q into itself", srcDSN)
+	}
+	// statements cached by the connections to dst may refer to the schema being replaced
+	defer atomic.AddUint64(&dst.schemaGen, 1)
+
+	if b, ok := src.bdb.(backuper); ok {
+		var bs backupStepper
+		if bs, err = b.backup(dst.bdb); err != nil {
+			return err
+		}
+		if bs != nil {
+			return runBackup(ctx, bs, pagesPerStep, progress)
+		}
+	}
+
+	total, err := backendQueryInt(src.bdb, "PRAGMA page_count")
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(int(total), int(total))
+	}
+	if err = backendCopy(ctx, src.bdb, dst.bdb); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(0, int(total))
+	}
+	return nil
+}
+
+// runBackup steps b to the end, pages pages at a time, yielding to the JS event loop between
+// steps.
+func runBackup(ctx context.Context, b backupStepper, pages int, progress func(remaining, total int)) (err error) {
+	defer func() {
+		if ferr := b.finish(); err == nil {
+			err = ferr
+		}
+	}()
+	if pages <= 0 {
+		pages = -1
+	}
+	for {
+		var done bool
+		var remaining, total int
+		if done, remaining, total, err = b.step(pages); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(remaining, total)
+		}
+		if done {
+			return nil
+		}
+		if err = yield(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// yield lets the JS event loop run, so that the page stays responsive during long operations.
+// It returns early with the error of ctx if ctx is done.
+func yield(ctx context.Context) error {
+	// the runtime only returns to the event loop once every goroutine is blocked, and runs
+	// timers due straight away without doing so
+	t := time.NewTimer(time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// backendCopy replaces the schema and rows of dst with those of src, in a single transaction on
+// dst and under a read transaction on src.
+func backendCopy(ctx context.Context, src, dst BackendDB) (err error) {
+	if err = backendExec(src, "SAVEPOINT go_sqlite_backup"); err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := backendExec(src, "RELEASE go_sqlite_backup"); err == nil {
+			err = rerr
+		}
+	}()
+	// foreign keys are only consistent again once every table has been copied
+	if err = backendExec(dst, "SAVEPOINT go_sqlite_backup; PRAGMA defer_foreign_keys = ON"); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			err = backendExec(dst, "RELEASE go_sqlite_backup")
+		} else if rerr := backendExec(dst, "ROLLBACK TO go_sqlite_backup; RELEASE go_sqlite_backup"); rerr != nil {
+			err = fmt.Errorf("%w (rollback: %s)", err, rerr)
+		}
+	}()
+
+	// dropping the tables drops their indexes and triggers along with them
+	old, err := backendQueryRows(dst, "SELECT type, name FROM sqlite_master WHERE type IN ('view', 'table') AND name NOT LIKE 'sqlite_%' ORDER BY type = 'table'")
+	if err != nil {
+		return err
+	}
+	for _, row := range old {
+		if err = backendExec(dst, fmt.Sprintf("DROP %s IF EXISTS %s", row[0], quoteIdent(row[1].(string)))); err != nil {
+			return err
+		}
+	}
+
+	schema, err := backendQueryRows(src, "SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	// virtual tables first, as they create their shadow tables, which are then copied as tables
+	var tables, others [][]driver.Value
+	for _, row := range schema {
+		switch {
+		case row[0] != "table":
+			others = append(others, row)
+		case strings.HasPrefix(strings.ToUpper(row[2].(string)), "CREATE VIRTUAL"):
+			if err = backendExec(dst, row[2].(string)); err != nil {
+				return err
+			}
+		default:
+			tables = append(tables, row)
+		}
+	}
+	for _, row := range tables {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name := row[1].(string)
+		var exists int64
+		if exists, err = backendQueryInt(dst, "SELECT count(*) FROM sqlite_master WHERE name = ?", name); err != nil {
+			return err
+		}
+		if exists == 0 {
+			err = backendExec(dst, row[2].(string))
+		} else {
+			err = backendExec(dst, "DELETE FROM "+quoteIdent(name))
+		}
+		if err == nil {
+			err = backendCopyRows(src, dst, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	seq, err := backendQueryInt(src, "SELECT count(*) FROM sqlite_master WHERE name = 'sqlite_sequence'")
+	if err != nil {
+		return err
+	}
+	if seq != 0 {
+		if err = backendExec(dst, "DELETE FROM sqlite_sequence"); err == nil {
+			err = backendCopyRows(src, dst, "sqlite_sequence")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, row := range others {
+		if err = backendExec(dst, row[2].(string)); err != nil {
+			return err
+		}
+	}
+	version, err := backendQueryInt(src, "PRAGMA user_version")
+	if err != nil {
+		return err
+	}
+	return backendExec(dst, fmt.Sprintf("PRAGMA user_version = %d", version))
+}
+
+// backendCopyRows copies the rows of table from src to dst, a batch at a time.
+func backendCopyRows(src, dst BackendDB, table string) (err error) {
+	s, _, err := src.Prepare("SELECT * FROM " + quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr := s.Finalize(); err == nil {
+			err = ferr
+		}
+	}()
+	cols, err := s.ColumnNames()
+	if err != nil {
+		return err
+	}
+	ins, _, err := dst.Prepare("INSERT INTO " + quoteIdent(table) + " VALUES(" + strings.Repeat("?, ", len(cols)-1) + "?)")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr := ins.Finalize(); err == nil {
+			err = ferr
+		}
+	}()
+	more, err := s.Step()
+	for more && err == nil {
+		var rows [][]driver.Value
+		if f, ok := s.(stmtRowFetcher); ok {
+			var batch rowBatch
+			if batch, more, err = f.fetchRows(copyBatchSize); err != nil {
+				return err
+			}
+			for batch.rows > 0 {
+				row := make([]driver.Value, len(cols))
+				if err = batch.next(row); err != nil {
+					return err
+				}
+				rows = append(rows, row)
+			}
+		} else {
+			for more && len(rows) < copyBatchSize {
+				row := make([]driver.Value, len(cols))
+				if err = s.Row(row); err != nil {
+					return err
+				}
+				rows = append(rows, row)
+				if more, err = s.Step(); err != nil {
+					return err
+				}
+			}
+		}
+		_, _, err = stmtBulkExec(dst, ins, rows)
+	}
+	return err
+}
+
+// snapshotConn serializes the database conn is connected to with Export, and returns a function
+// which restores the database to the snapshot. The restore isn't canceled with any context, as it
+// is most needed when a step failed because its context was.
+func snapshotConn(conn *sql.Conn) (restore func() error, err error) {
+	var db *database
+	err = conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*SqliteJsConn)
+		if !ok {
+			return fmt.Errorf("can't snapshot a %T", driverConn)
+		}
+		db = c.db
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	opener, ok := db.bdb.(imageOpener)
+	if !ok {
+		return nil, errors.New("the backend can't restore snapshots")
+	}
+	data, err := db.bdb.Export()
+	// sql.js frees every prepared statement on export, so the cached ones must be prepared again
+	atomic.AddUint64(&db.schemaGen, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func() (err error) {
+		img, err := opener.openImage(data)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := img.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		defer atomic.AddUint64(&db.schemaGen, 1)
+		return backendCopy(context.Background(), img, db.bdb)
+	}, nil
+}
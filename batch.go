@@ -0,0 +1,154 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"syscall/js"
+)
+
+// maxSafeInteger is the largest integer a JS number can represent exactly.
+const maxSafeInteger = 1<<53 - 1
+
+const (
+	// The number of rows fetched by the first batch of a query. Later batches double in size up
+	// to fetchBatchMax, so that QueryRow doesn't step through rows it will never read but large
+	// scans cross the Go/JS boundary rarely.
+	fetchBatchMin = 16
+	fetchBatchMax = 1024
+)
+
+// Tags of the values packed by the fetchRows JS helper.
+const (
+	tagNull byte = iota
+	tagInteger
+	tagReal
+	tagText
+	tagBlob
+	tagOther
+	tagInt64
+)
+
+// rowBatch is a batch of rows fetched from a statement in a single call to the fetchRows JS
+// helper. The rows are packed into buf as a sequence of values, each of which is a tag byte
+// followed by nothing for NULL, a little-endian float64 for numbers or int64 for BigInts, or a
+// little-endian uint32 and then either that many bytes for text and blobs or an index into others
+// for values the helper couldn't pack.
+type rowBatch struct {
+	buf    []byte
+	rows   int // rows left to decode from buf
+	others js.Value
+}
+
+// readRowBatch reads a batch packed by the fetchRows or packRow JS helper, and whether there
+// are more rows to fetch.
+func readRowBatch(res js.Value) (rowBatch, bool) {
+	jsBuf := res.Get("buf")
+	batch := rowBatch{
+		buf:    make([]byte, jsBuf.Length()),
+		rows:   res.Get("count").Int(),
+		others: res.Get("others"),
+	}
+	js.CopyBytesToGo(batch.buf, jsBuf)
+	return batch, res.Get("more").Bool()
+}
+
+// nextLocked reads the next row into dest, fetching a batch of rows if the statement can;
+// must be called with locked mutex.
+func (s *SqliteJsStmt) nextLocked(dest []driver.Value) (err error) {
+	f, ok := s.bs.(stmtRowFetcher)
+	if !ok {
+		if !s.hasNext {
+			return io.EOF
+		}
+		if err = s.bs.Row(dest); err != nil {
+			return err
+		}
+		s.hasNext, err = s.bs.Step()
+		return err
+	}
+	if s.batch.rows == 0 {
+		if !s.hasNext {
+			return io.EOF
+		}
+		switch {
+		case s.fetchSize < fetchBatchMin:
+			s.fetchSize = fetchBatchMin
+		case s.fetchSize < fetchBatchMax:
+			s.fetchSize *= 2
+		}
+		if s.batch, s.hasNext, err = f.fetchRows(s.fetchSize); err != nil {
+			s.hasNext = false
+			return err
+		}
+	}
+	return s.batch.next(dest)
+}
+
+// next decodes the next row of the batch into dest.
+func (b *rowBatch) next(dest []driver.Value) error {
+	// the rest of the row is decoded after a value which can't be, so the batch stays usable
+	var decodeErr error
+	for i := range dest {
+		if len(b.buf) == 0 {
+			return fmt.Errorf("row batch: truncated at column %d", i)
+		}
+		tag := b.buf[0]
+		b.buf = b.buf[1:]
+		switch tag {
+		case tagNull:
+			dest[i] = nil
+			continue
+		case tagInt64:
+			if len(b.buf) < 8 {
+				return fmt.Errorf("row batch: truncated number at column %d", i)
+			}
+			dest[i] = int64(binary.LittleEndian.Uint64(b.buf))
+			b.buf = b.buf[8:]
+			continue
+		case tagInteger, tagReal:
+			if len(b.buf) < 8 {
+				return fmt.Errorf("row batch: truncated number at column %d", i)
+			}
+			f := math.Float64frombits(binary.LittleEndian.Uint64(b.buf))
+			b.buf = b.buf[8:]
+			if tag == tagInteger {
+				dest[i] = int64(f)
+			} else {
+				dest[i] = f
+			}
+			continue
+		}
+		if len(b.buf) < 4 {
+			return fmt.Errorf("row batch: truncated value at column %d", i)
+		}
+		n := int(binary.LittleEndian.Uint32(b.buf))
+		b.buf = b.buf[4:]
+		if tag == tagOther {
+			var err error
+			if dest[i], err = decodeValue(b.others.Index(n), i); err != nil && decodeErr == nil {
+				decodeErr = err
+			}
+			continue
+		}
+		if len(b.buf) < n {
+			return fmt.Errorf("row batch: truncated value at column %d", i)
+		}
+		switch tag {
+		case tagText:
+			dest[i] = string(b.buf[:n])
+		case tagBlob:
+			dest[i] = b.buf[:n:n]
+		default:
+			return fmt.Errorf("row batch: unknown tag %d at column %d", tag, i)
+		}
+		b.buf = b.buf[n:]
+	}
+	b.rows--
+	return decodeErr
+}
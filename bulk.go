@@ -0,0 +1,77 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// BulkInsert runs query, a single statement such as an INSERT with placeholders, once for each
+// of rows in a single call across the Go/JS boundary for the built-in backends. The rows are
+// inserted inside a savepoint, so that either all or none of them are. The result reports the
+// total number of rows changed and the rowid of the last insert. Values must already be
+// driver.Values, as database/sql doesn't convert them.
+//
+// BulkInsert is reachable via sql.Conn.Raw:
+//
+//	err = conn.Raw(func(driverConn interface{}) error {
+//	    res, err = driverConn.(*sqlite3_js.SqliteJsConn).BulkInsert(ctx, query, rows)
+//	    return err
+//	})
+func (conn *SqliteJsConn) BulkInsert(ctx context.Context, query string, rows [][]driver.Value) (result driver.Result, err error) {
+	defer protect(conn.log, "BulkInsert", func(e error) { err = e })
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := conn.prepareCached(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		var tail string
+		if s, tail, err = conn.nextStatement(ctx, query); err != nil {
+			return nil, err
+		}
+		if s == nil {
+			return nil, fmt.Errorf("nothing to prepare, query: %s", query)
+		}
+		if !isBlankSQL(tail) {
+			// the rows would only be inserted by the first statement
+			s.Close()
+			return nil, fmt.Errorf("can't bulk insert with several statements, query: %s", query)
+		}
+	}
+	defer s.Close()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	ev := TraceEvent{SQL: s.sql}
+	for _, row := range rows {
+		ev.Args += len(row)
+	}
+	if conn.tr != nil {
+		ctx = conn.tr.OnExecStart(ctx, ev)
+	}
+	start := time.Now()
+	changes, id, err := stmtBulkExec(conn.db.bdb, s.bs, rows)
+	conn.logStmt("exec", query, start, err)
+	ev.Duration, ev.RowsAffected, ev.Err = time.Since(start), changes, err
+	status, _ := conn.readStatus(s.bs)
+	stmtStats.record(s.sql, ev, status)
+	if conn.tr != nil {
+		conn.tr.OnExecEnd(ctx, ev)
+	}
+	if err != nil {
+		// the statement may be unusable, e.g. freed by Database.export(), so don't cache it
+		s.cache = nil
+		return nil, err
+	}
+	return &SqliteJsResult{
+		changes: changes,
+		id:      id,
+	}, nil
+}
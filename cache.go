@@ -0,0 +1,157 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// The default size of the per-connection prepared statement cache, overridden with the
+// _stmt_cache_size DSN option. A size of 0 disables the cache.
+const defaultStmtCacheSize = 32
+
+// stmtCache is an LRU cache of prepared statements keyed by SQL text. Statements are
+// taken out of the cache while they are in use, so that each is only used by one SqliteJsStmt
+// at a time, and put back reset when that is closed.
+type stmtCache struct {
+	mu      sync.Mutex
+	db      *database
+	size    int
+	gen     uint64     // schema generation of db the cached statements were prepared at
+	lru     *list.List // of *cachedStmt, most recently used at the front
+	entries map[string]*list.Element
+	live    *int32 // the statements of the connection, counted down as cached ones are freed
+}
+
+type cachedStmt struct {
+	query string
+	stmt  BackendStmt
+	multi bool // query holds several statements, so isn't cached
+}
+
+func newStmtCache(db *database, size int, live *int32) *stmtCache {
+	return &stmtCache{
+		db:      db,
+		size:    size,
+		gen:     atomic.LoadUint64(&db.schemaGen),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		live:    live,
+	}
+}
+
+// take removes the statement cached for query from the cache, returning it along with the
+// schema generation it was prepared at. multi reports whether query is known to hold several
+// statements instead.
+func (c *stmtCache) take(query string) (stmt BackendStmt, gen uint64, ok, multi bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkSchemaLocked()
+	e, ok := c.entries[query]
+	if !ok {
+		return nil, c.gen, false, false
+	}
+	entry := e.Value.(*cachedStmt)
+	if entry.multi {
+		c.lru.MoveToFront(e)
+		return nil, c.gen, false, true
+	}
+	c.lru.Remove(e)
+	delete(c.entries, query)
+	return entry.stmt, c.gen, true, false
+}
+
+// put resets stmt and caches it for query. stmt is freed instead if the schema changed since
+// gen or the cache already holds a statement for query.
+func (c *stmtCache) put(query string, stmt BackendStmt, gen uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkSchemaLocked()
+	if _, exists := c.entries[query]; exists || gen != c.gen {
+		return c.free(stmt)
+	}
+	if err := stmt.Reset(); err != nil {
+		return c.free(stmt)
+	}
+	c.entries[query] = c.lru.PushFront(&cachedStmt{
+		query: query,
+		stmt:  stmt,
+	})
+	return c.evictLocked()
+}
+
+// putMulti remembers that query holds several statements, so that it isn't prepared just to
+// find that out again.
+func (c *stmtCache) putMulti(query string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[query]; exists {
+		return
+	}
+	c.entries[query] = c.lru.PushFront(&cachedStmt{
+		query: query,
+		multi: true,
+	})
+	_ = c.evictLocked()
+}
+
+// evictLocked frees the least recently used statements beyond the size of the cache; must be
+// called with locked mutex.
+func (c *stmtCache) evictLocked() (err error) {
+	for c.lru.Len() > c.size {
+		entry := c.lru.Remove(c.lru.Back()).(*cachedStmt)
+		delete(c.entries, entry.query)
+		if !entry.multi {
+			if ferr := c.free(entry.stmt); ferr != nil {
+				err = ferr
+			}
+		}
+	}
+	return err
+}
+
+// free finalizes stmt, which leaves the cache.
+func (c *stmtCache) free(stmt BackendStmt) error {
+	atomic.AddInt32(c.live, -1)
+	return stmt.Finalize()
+}
+
+// checkSchemaLocked empties the cache if the schema changed since the cached statements were
+// prepared; must be called with locked mutex.
+func (c *stmtCache) checkSchemaLocked() {
+	if gen := atomic.LoadUint64(&c.db.schemaGen); gen != c.gen {
+		c.clearLocked()
+		c.gen = gen
+	}
+}
+
+// clear frees all cached statements.
+func (c *stmtCache) clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clearLocked()
+}
+
+func (c *stmtCache) clearLocked() error {
+	size := c.size
+	c.size = 0
+	err := c.evictLocked()
+	c.size = size
+	return err
+}
+
+// isSchemaChange reports whether query changes the schema, which invalidates cached statements.
+func isSchemaChange(query string) bool {
+	query = strings.TrimLeftFunc(query, unicode.IsSpace)
+	for _, keyword := range []string{"CREATE", "DROP", "ALTER"} {
+		if len(query) > len(keyword) && strings.EqualFold(query[:len(keyword)], keyword) && unicode.IsSpace(rune(query[len(keyword)])) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,29 +1,106 @@
+//go:build js && wasm
+// +build js,wasm
+
 package sqlite3_js //nolint:golint
 
 import (
 	"context"
 	"database/sql/driver"
 	"fmt"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall/js"
+	"time"
 )
 
 // SqliteJsConn implements driver.Conn.
 type SqliteJsConn struct {
-	JsDb js.Value // sql.js SQL.Database : https://sql-js.github.io/sql.js/documentation/class/Database.html
-	mu   *sync.Mutex
+	JsDb  js.Value // the JS database object of the backend, e.g. a sql.js SQL.Database : https://sql-js.github.io/sql.js/documentation/class/Database.html
+	mu    *sync.Mutex
+	db    *database
+	cache *stmtCache // nil if disabled
+	dsn   string
+	log   Logger           // nil if silent
+	tr    Tracer           // nil if not tracing
+	slow  *SlowPlanOptions // nil if not logging slow plans
+	stmts int32            // statements not yet finalized, cached ones included, for DBStats; accessed atomically
+	rows  int32            // open rows, for DBStats; accessed atomically
 }
 
 // Prepare creates a prepared statement for later queries or executions. Multiple
 // queries or executions may be run concurrently from the returned statement. The
 // caller must call the statement's Close method when the statement is no longer
 // needed.
-func (conn *SqliteJsConn) Prepare(query string) (stmt driver.Stmt, err error) {
-	defer protect("Prepare", func(e error) { err = e })
+func (conn *SqliteJsConn) Prepare(query string) (driver.Stmt, error) {
+	return conn.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext returns a prepared statement, bound to this connection. The context is only
+// passed to the Tracer, as preparing a statement can't be canceled.
+func (conn *SqliteJsConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	defer protect(conn.log, "Prepare", func(e error) { err = e })
+	s, err := conn.prepareCached(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		return s, nil
+	}
+	start := time.Now()
+	s, _, err = conn.nextStatement(ctx, query)
+	if err == nil && s == nil {
+		err = fmt.Errorf("nothing to prepare, query: %s", query)
+		conn.tracePrepare(ctx, query, start, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// tracePrepare calls Tracer.OnPrepare, if set, for the statement sql prepared since start.
+func (conn *SqliteJsConn) tracePrepare(ctx context.Context, sql string, start time.Time, err error) {
+	if conn.tr != nil {
+		conn.tr.OnPrepare(ctx, TraceEvent{SQL: sql, Duration: time.Since(start), Err: err})
+	}
+}
+
+// prepareCached prepares query through the connection's statement cache. It returns nil if the
+// cache is disabled, or if query holds several statements or fails to prepare, neither of which
+// are cached.
+func (conn *SqliteJsConn) prepareCached(ctx context.Context, query string) (*SqliteJsStmt, error) {
+	if conn.cache == nil {
+		return nil, nil
+	}
+	start := time.Now()
+	bs, gen, ok, multi := conn.cache.take(query)
+	if multi {
+		return nil, nil
+	}
+	if !ok {
+		var tail string
+		var err error
+		bs, tail, err = conn.db.bdb.Prepare(query)
+		if err != nil || bs == nil {
+			// leave it to the uncached path to report the error
+			return nil, nil
+		}
+		if !isBlankSQL(tail) {
+			conn.cache.putMulti(query)
+			if err = bs.Finalize(); err != nil {
+				conn.tracePrepare(ctx, query, start, err)
+			}
+			return nil, err
+		}
+		atomic.AddInt32(&conn.stmts, 1)
+	}
+	conn.tracePrepare(ctx, query, start, nil)
 	return &SqliteJsStmt{
-		c:  conn,
-		js: conn.JsDb.Call("prepare", query),
+		c:        conn,
+		bs:       bs,
+		sql:      query,
+		cache:    conn.cache,
+		cacheGen: gen,
 	}, nil
 }
 
@@ -31,31 +108,20 @@ func (conn *SqliteJsConn) Prepare(query string) (stmt driver.Stmt, err error) {
 // Close will return with ErrConnDone. Close is safe to call concurrently with
 // other operations and will block until all other operations finish. It may be
 // useful to first cancel any used context and then call close directly after.
-func (conn SqliteJsConn) Close() error {
-	// TODO
+func (conn *SqliteJsConn) Close() error {
+	conn.db.connsMu.Lock()
+	delete(conn.db.conns, conn)
+	conn.db.connsMu.Unlock()
+	if conn.cache != nil {
+		return conn.cache.clear()
+	}
 	return nil
 }
 
-func (conn *SqliteJsConn) Exec(query string, args []driver.Value) (result driver.Result, err error) {
-	defer protect("Exec", func(e error) { err = e })
-	query = strings.TrimRight(query, ";")
-	if strings.Contains(query, ";") {
-		if len(args) != 0 {
-			return nil, fmt.Errorf("cannot exec multiple statements with placeholders, query: %s nargs=%d", query, len(args))
-		}
-		jsVal, err := jsTryCatch(func() js.Value {
-			return conn.JsDb.Call("exec", query)
-		})
-		if err != nil {
-			return nil, err
-		}
-		return &SqliteJsResult{
-			js:      jsVal,
-			changes: 0,
-			id:      0,
-		}, nil
-	}
-
+// Exec executes a query that doesn't return rows, such as an INSERT or UPDATE.
+//
+// Deprecated: Drivers should implement ExecerContext instead (or additionally).
+func (conn *SqliteJsConn) Exec(query string, args []driver.Value) (driver.Result, error) {
 	list := make([]namedValue, len(args))
 	for i, v := range args {
 		list[i] = namedValue{
@@ -66,16 +132,166 @@ func (conn *SqliteJsConn) Exec(query string, args []driver.Value) (result driver
 	return conn.exec(context.Background(), query, list)
 }
 
-func (conn *SqliteJsConn) exec(ctx context.Context, query string, args []namedValue) (driver.Result, error) {
-	// FIXME: we removed tbe ability to handle 'tails' - is this a problem?
-	s, err := conn.Prepare(query)
+// ExecContext executes a query that doesn't return rows, such as an INSERT or UPDATE,
+// without the separate prepare and close round trips of a prepared statement.
+//
+// ExecContext must honor the context timeout and return when it is canceled.
+func (conn *SqliteJsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	list := make([]namedValue, len(args))
+	for i, nv := range args {
+		list[i] = namedValue(nv)
+	}
+	return conn.exec(ctx, query, list)
+}
+
+// QueryContext executes a query that may return rows, such as a SELECT. The statement
+// is prepared, run and freed in one step: it is closed when the returned rows are closed.
+//
+// QueryContext must honor the context timeout and return when it is canceled.
+func (conn *SqliteJsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	list := make([]namedValue, len(args))
+	for i, nv := range args {
+		list[i] = namedValue(nv)
+	}
+	return conn.query(ctx, query, list)
+}
+
+func (conn *SqliteJsConn) query(ctx context.Context, query string, args []namedValue) (rows driver.Rows, err error) {
+	defer protect(conn.log, "Query", func(e error) { err = e })
+	s, err := conn.prepareCached(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		var r *SqliteJsRows
+		if r, err = conn.queryStatement(ctx, s, "", args); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	s, tail, err := conn.nextStatement(ctx, query)
+	if err == nil && s == nil {
+		err = fmt.Errorf("nothing to query, query: %s", query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := conn.queryStatement(ctx, s, tail, args)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// queryStatement runs s as a connection-level query, consuming as many of args as it has
+// placeholders. The returned rows keep hold of the statements following s in the query, if
+// any, and the remaining args for their next result set. If s is the last statement, it is an
+// error for any args to be left.
+func (conn *SqliteJsConn) queryStatement(ctx context.Context, s *SqliteJsStmt, tail string, args []namedValue) (*SqliteJsRows, error) {
+	n := s.numParams()
+	if n > len(args) {
+		s.Close()
+		return nil, fmt.Errorf("not enough args to query statement, query: %s nargs=%d want=%d", s.sql, len(args), n)
+	}
+	s.cls = true
+	rows, err := s.query(ctx, args[:n])
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	r := rows.(*SqliteJsRows)
+	r.tail = tail
+	r.args = args[n:]
+	if isBlankSQL(tail) && len(r.args) != 0 {
+		r.Close()
+		return nil, fmt.Errorf("too many args to query, query: %s nargs left=%d", s.sql, len(r.args))
+	}
+	return r, nil
+}
+
+// exec runs each statement of query in turn, consuming as many of args as each statement has
+// placeholders. The result reports the rowid of the last statement and the total number of changes.
+func (conn *SqliteJsConn) exec(ctx context.Context, query string, args []namedValue) (result driver.Result, err error) {
+	defer protect(conn.log, "Exec", func(e error) { err = e })
+	s, err := conn.prepareCached(ctx, query)
 	if err != nil {
 		return nil, err
 	}
-	var res driver.Result
-	res, err = s.(*SqliteJsStmt).exec(ctx, args)
-	s.Close()
-	return res, err
+	if s != nil {
+		var res *SqliteJsResult
+		var rest []namedValue
+		res, rest, err = conn.execStatement(ctx, s, args)
+		if err == nil && len(rest) != 0 {
+			err = fmt.Errorf("too many args to exec, query: %s nargs left=%d", query, len(rest))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	res := &SqliteJsResult{}
+	tail := query
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		s, tail, err = conn.nextStatement(ctx, tail)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			break
+		}
+		var sr *SqliteJsResult
+		sr, args, err = conn.execStatement(ctx, s, args)
+		if err != nil {
+			return nil, err
+		}
+		res.id = sr.id
+		res.changes += sr.changes
+	}
+	if len(args) != 0 {
+		return nil, fmt.Errorf("too many args to exec, query: %s nargs left=%d", query, len(args))
+	}
+	return res, nil
+}
+
+// execStatement runs and closes s, consuming as many of args as it has placeholders. It
+// returns the args left over.
+func (conn *SqliteJsConn) execStatement(ctx context.Context, s *SqliteJsStmt, args []namedValue) (*SqliteJsResult, []namedValue, error) {
+	defer s.Close()
+	n := s.numParams()
+	if n > len(args) {
+		return nil, nil, fmt.Errorf("not enough args to exec statement, query: %s nargs=%d want=%d", s.sql, len(args), n)
+	}
+	res, err := s.exec(ctx, args[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.(*SqliteJsResult), args[n:], nil
+}
+
+// nextStatement prepares the first statement of query, returning it along with the rest of
+// query, or nil once there are no statements left.
+func (conn *SqliteJsConn) nextStatement(ctx context.Context, query string) (*SqliteJsStmt, string, error) {
+	start := time.Now()
+	bs, tail, err := conn.db.bdb.Prepare(query)
+	if err != nil {
+		conn.tracePrepare(ctx, query, start, err)
+		return nil, "", err
+	}
+	if bs == nil {
+		return nil, "", nil
+	}
+	conn.tracePrepare(ctx, bs.SQL(), start, nil)
+	atomic.AddInt32(&conn.stmts, 1)
+	return &SqliteJsStmt{
+		c:   conn,
+		bs:  bs,
+		sql: bs.SQL(),
+	}, tail, nil
 }
 
 // Transactions
@@ -112,3 +328,53 @@ func (conn *SqliteJsConn) begin(ctx context.Context) (driver.Tx, error) { //noli
 		} */
 	return &SqliteJsTx{c: conn}, nil
 }
+
+// logStmt logs the statement sql having been run since start, at LogDebug, or at LogWarn along
+// with err if it failed.
+func (conn *SqliteJsConn) logStmt(msg, sql string, start time.Time, err error) {
+	if conn.log == nil {
+		return
+	}
+	fields := []LogField{{FieldDSN, conn.dsn}, {FieldSQL, sql}, {FieldDuration, time.Since(start)}}
+	if err == nil {
+		conn.log.Log(LogDebug, msg, fields...)
+		return
+	}
+	fields = append(fields, LogField{FieldError, err})
+	if code, ok := errorCode(err); ok {
+		fields = append(fields, LogField{FieldErrorCode, code})
+	}
+	conn.log.Log(LogWarn, msg, fields...)
+}
+
+// readStatus reads the sqlite3_stmt_status counters of s, if statistics or SlowPlans need them.
+func (conn *SqliteJsConn) readStatus(s BackendStmt) (stmtStatus, bool) {
+	if !stmtStats.enabled() && (conn.slow == nil || !conn.slow.FullScans) {
+		return stmtStatus{}, false
+	}
+	return readStmtStatus(s)
+}
+
+// logSlowPlan logs the plan of the statement sql, which ran with args for d, at LogWarn if it
+// was slow, or scanned a table in full and SlowPlanOptions.FullScans is set. The plan is only
+// explained when needed, using the full scan steps in status if the backend reports them.
+func (conn *SqliteJsConn) logSlowPlan(sql string, args []driver.Value, d time.Duration, status stmtStatus, statusOK bool) {
+	if conn.slow == nil || conn.log == nil {
+		return
+	}
+	slow := conn.slow.Threshold > 0 && d > conn.slow.Threshold
+	if !slow && !(conn.slow.FullScans && (!statusOK || status.fullScanSteps > 0)) {
+		return
+	}
+	plan, err := backendExplain(conn.db.bdb, sql, args...)
+	if !slow && (err != nil || !hasFullScan(plan)) {
+		return
+	}
+	fields := []LogField{{FieldDSN, conn.dsn}, {FieldSQL, sql}, {FieldDuration, d}}
+	if err != nil {
+		fields = append(fields, LogField{FieldError, err})
+	} else {
+		fields = append(fields, LogField{FieldPlan, formatPlan(plan)})
+	}
+	conn.log.Log(LogWarn, "slow plan", fields...)
+}
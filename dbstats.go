@@ -0,0 +1,58 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DBStats returns the statistics of the database opened with dsn by the default driver, e.g.
+// to VACUUM or drop caches before the tab runs out of memory. The database must be open.
+func DBStats(dsn string) (*DatabaseStats, error) {
+	return (&SqliteJsDriver{}).DBStats(dsn)
+}
+
+// DBStats returns the statistics of the database opened with dsn by the driver. The database
+// must be open.
+func (d *SqliteJsDriver) DBStats(dsn string) (*DatabaseStats, error) {
+	db, _, err := d.database(dsn, false)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, fmt.Errorf("database %q isn't open", dsn)
+	}
+	return db.stats()
+}
+
+// stats returns the statistics of the database.
+func (db *database) stats() (*DatabaseStats, error) {
+	st := &DatabaseStats{MemoryUsed: -1, MemoryHighwater: -1, HeapSize: -1}
+	if m, ok := db.bdb.(memoryStatser); ok {
+		st.MemoryUsed, st.MemoryHighwater, st.HeapSize = m.memoryStats()
+	}
+	var err error
+	if st.PageCount, err = backendQueryInt(db.bdb, "PRAGMA page_count"); err != nil {
+		return nil, err
+	}
+	if st.PageSize, err = backendQueryInt(db.bdb, "PRAGMA page_size"); err != nil {
+		return nil, err
+	}
+	if st.FreelistCount, err = backendQueryInt(db.bdb, "PRAGMA freelist_count"); err != nil {
+		return nil, err
+	}
+	// sqlite3_serialize writes every page, so this is the size of Export without copying it
+	st.ImageSize = st.PageCount * st.PageSize
+
+	db.connsMu.Lock()
+	defer db.connsMu.Unlock()
+	for c := range db.conns {
+		st.Conns = append(st.Conns, ConnStats{
+			Stmts: int(atomic.LoadInt32(&c.stmts)),
+			Rows:  int(atomic.LoadInt32(&c.rows)),
+		})
+	}
+	return st, nil
+}
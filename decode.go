@@ -0,0 +1,149 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"database/sql/driver"
+	"math"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// Decoder converts a JS value returned by the backend into a driver.Value. ok is false if the
+// decoder doesn't handle v, leaving it to the next one.
+type Decoder func(v js.Value) (value driver.Value, ok bool, err error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   []Decoder
+)
+
+// RegisterDecoder adds d to the decoders tried in order of registration for values the driver
+// can't convert itself, such as those returned by custom SQL functions. The driver converts
+// null, booleans, numbers, strings, BigInts within the range of int64 and binary data.
+func RegisterDecoder(d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders = append(decoders, d)
+}
+
+var (
+	jsTypeOfOnce sync.Once
+	jsTypeOfFn   js.Value
+)
+
+// jsTypeOf returns typeof v, which unlike v.Type() doesn't panic for BigInts.
+func jsTypeOf(v js.Value) string {
+	jsTypeOfOnce.Do(func() {
+		jsTypeOfFn = js.Global().Get("Function").New("v", "return v === null ? 'null' : typeof v")
+	})
+	return jsTypeOfFn.Invoke(v).String()
+}
+
+// decodeValue converts a JS value returned by the backend for column into a driver.Value.
+func decodeValue(jsVal js.Value, column int) (driver.Value, error) {
+	typ := jsTypeOf(jsVal)
+	switch typ {
+	case "null", "undefined":
+		return nil, nil
+	case "boolean":
+		return jsVal.Bool(), nil
+	case "number":
+		// backends return both INTEGER and REAL values as numbers
+		if f := jsVal.Float(); f == math.Trunc(f) && math.Abs(f) <= maxSafeInteger {
+			return int64(f), nil
+		}
+		return jsVal.Float(), nil
+	case "string":
+		return jsVal.String(), nil
+	case "object":
+		if b, ok := jsBytes(jsVal); ok {
+			return b, nil
+		}
+	}
+
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	for _, d := range decoders {
+		if v, ok, err := d(jsVal); ok || err != nil {
+			if de, isDecodeErr := err.(*DecodeError); isDecodeErr {
+				de.Column = column
+			}
+			return v, err
+		}
+	}
+	return nil, &DecodeError{
+		Column: column,
+		Type:   jsTypeName(jsVal, typ),
+	}
+}
+
+// jsBytes copies the bytes of an ArrayBuffer or a view of one, such as a Uint8Array.
+func jsBytes(v js.Value) ([]byte, bool) {
+	arrayBuffer := js.Global().Get("ArrayBuffer")
+	var u8 js.Value
+	switch {
+	case v.InstanceOf(arrayBuffer):
+		u8 = js.Global().Get("Uint8Array").New(v)
+	case arrayBuffer.Call("isView", v).Bool():
+		u8 = js.Global().Get("Uint8Array").New(v.Get("buffer"), v.Get("byteOffset"), v.Get("byteLength"))
+	default:
+		return nil, false
+	}
+	b := make([]byte, u8.Length())
+	js.CopyBytesToGo(b, u8)
+	return b, true
+}
+
+// jsTypeName returns typ, the JS type of v, or the name of its constructor for objects.
+func jsTypeName(v js.Value, typ string) string {
+	if typ == "object" {
+		if name := v.Get("constructor").Get("name"); name.Type() == js.TypeString && name.String() != "" {
+			return name.String()
+		}
+	}
+	return typ
+}
+
+// DecodeBigInt is a Decoder converting BigInts outside the range of int64 to their decimal
+// string, e.g. for scanning into a big.Int.
+func DecodeBigInt(v js.Value) (driver.Value, bool, error) {
+	if jsTypeOf(v) != "bigint" {
+		return nil, false, nil
+	}
+	return v.Call("toString").String(), true, nil
+}
+
+// DecodeDate is a Decoder converting Dates to time.Time.
+func DecodeDate(v js.Value) (driver.Value, bool, error) {
+	if jsTypeOf(v) != "object" || !v.InstanceOf(js.Global().Get("Date")) {
+		return nil, false, nil
+	}
+	ms := v.Call("getTime").Float()
+	if math.IsNaN(ms) {
+		return nil, true, &DecodeError{Type: "Invalid Date"}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC(), true, nil
+}
+
+// DecodeJSON is a Decoder converting plain objects and arrays to their JSON encoding, e.g. for
+// scanning into a json.RawMessage.
+func DecodeJSON(v js.Value) (driver.Value, bool, error) {
+	if jsTypeOf(v) != "object" {
+		return nil, false, nil
+	}
+	object := js.Global().Get("Object")
+	if proto := object.Call("getPrototypeOf", v); !js.Global().Get("Array").Call("isArray", v).Bool() &&
+		!proto.IsNull() && !proto.Equal(object.Get("prototype")) {
+		return nil, false, nil
+	}
+	s, err := jsTryCatch(func() js.Value {
+		return js.Global().Get("JSON").Call("stringify", v)
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	return []byte(s.String()), true, nil
+}
@@ -0,0 +1,28 @@
+package sqlite3_js //nolint:golint
+
+import "fmt"
+
+// DriverName is the name the driver is registered under with database/sql.
+const DriverName = "sqlite3_js"
+
+// Config configures how Init loads sql.js.
+type Config struct {
+	// WasmURL is the URL sql-wasm.wasm is fetched from. If empty, sql.js looks for it next to
+	// sql-wasm.js.
+	WasmURL string
+	// WasmBytes is the contents of sql-wasm.wasm, used instead of fetching it if set.
+	WasmBytes []byte
+}
+
+// DecodeError is returned by Rows.Next for a value returned by the backend which neither the
+// driver nor the decoders registered with RegisterDecoder can convert to a Go value. database/sql
+// closes the rows on such an error, so the rows after it can't be read.
+type DecodeError struct {
+	Column int
+	// Type is the JS type of the value, e.g. "symbol", or its constructor for objects, e.g. "Date".
+	Type string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("sqlite3_js: can't decode JS %s value of column %d", e.Type, e.Column)
+}
@@ -0,0 +1,43 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// options are the connection options set by the DSN parameters.
+type options struct {
+	// The size of the per-connection prepared statement cache, 0 disables it. Set with _stmt_cache_size.
+	stmtCacheSize int
+	// The SQLite VFS to open the database with, e.g. "opfs", or empty for the default of the
+	// backend. Set with vfs.
+	vfs string
+}
+
+// parseDSN splits a DSN of the form [file:]name[?param=value&...] into the database name and
+// the connection options set by its parameters. Unknown parameters are ignored.
+func parseDSN(dsn string) (name string, opts options, err error) {
+	opts.stmtCacheSize = defaultStmtCacheSize
+	name = strings.TrimPrefix(dsn, "file:")
+	i := strings.IndexByte(name, '?')
+	if i < 0 {
+		return name, opts, nil
+	}
+	params, err := url.ParseQuery(name[i+1:])
+	if err != nil {
+		return "", opts, fmt.Errorf("invalid DSN %q: %s", dsn, err)
+	}
+	name = name[:i]
+	if v := params.Get("_stmt_cache_size"); v != "" {
+		if opts.stmtCacheSize, err = strconv.Atoi(v); err != nil || opts.stmtCacheSize < 0 {
+			return "", opts, fmt.Errorf("invalid DSN %q: _stmt_cache_size must be a non-negative integer", dsn)
+		}
+	}
+	opts.vfs = params.Get("vfs")
+	return name, opts, nil
+}
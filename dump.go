@@ -0,0 +1,285 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump writes the schema and rows of the database conn is connected to as SQL text to w, in the
+// style of the .dump command of the sqlite3 shell: tables with their rows, then indexes,
+// triggers and views. It can be read back with Restore or the shell. The database is read in a
+// single transaction, so the dump is consistent.
+func Dump(ctx context.Context, conn *sql.Conn, w io.Writer) (err error) {
+	if _, err = conn.ExecContext(ctx, "SAVEPOINT go_sqlite_dump"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, rerr := conn.ExecContext(context.Background(), "RELEASE go_sqlite_dump"); err == nil {
+			err = rerr
+		}
+	}()
+	tables, err := querySchema(ctx, conn, "type = 'table' ORDER BY name = 'sqlite_sequence', rowid")
+	if err != nil {
+		return fmt.Errorf("read schema: %w", err)
+	}
+	others, err := querySchema(ctx, conn, "type IN ('index', 'trigger', 'view') ORDER BY rowid")
+	if err != nil {
+		return fmt.Errorf("read schema: %w", err)
+	}
+
+	sw := &stickyWriter{w: bufio.NewWriter(w)}
+	sw.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	writableSchema := false
+	for _, t := range tables {
+		switch {
+		case t.name == "sqlite_sequence":
+			sw.WriteString("DELETE FROM sqlite_sequence;\n")
+		case strings.HasPrefix(t.name, "sqlite_"):
+			// internal tables such as sqlite_stat1 are rebuilt by SQLite
+			continue
+		case strings.HasPrefix(strings.ToUpper(t.sql), "CREATE VIRTUAL TABLE"):
+			// creating the table would create its shadow tables, which are dumped as tables
+			if !writableSchema {
+				sw.WriteString("PRAGMA writable_schema=ON;\n")
+				writableSchema = true
+			}
+			sw.WriteString("INSERT INTO sqlite_master(type,name,tbl_name,rootpage,sql)VALUES('table'," +
+				quoteString(t.name) + "," + quoteString(t.name) + ",0," + quoteString(t.sql) + ");\n")
+			continue
+		default:
+			sw.WriteString(t.sql + ";\n")
+		}
+		if err = dumpRows(ctx, conn, sw, t.name); err != nil {
+			return fmt.Errorf("dump table %s: %w", t.name, err)
+		}
+	}
+	for _, o := range others {
+		sw.WriteString(o.sql + ";\n")
+	}
+	if writableSchema {
+		sw.WriteString("PRAGMA writable_schema=OFF;\n")
+	}
+	sw.WriteString("COMMIT;\n")
+	return sw.Flush()
+}
+
+// stickyWriter is a bufio.Writer keeping the first error it fails with, so that a sequence of
+// writes is checked once.
+type stickyWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *stickyWriter) WriteString(s string) {
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+func (w *stickyWriter) Write(p []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+}
+
+// Flush writes any buffered data, and returns the first error of the writes.
+func (w *stickyWriter) Flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// schemaObject is a row of sqlite_master.
+type schemaObject struct {
+	name string
+	sql  string
+}
+
+// querySchema returns the objects of sqlite_master matching where, which have SQL.
+func querySchema(ctx context.Context, conn *sql.Conn, where string) ([]schemaObject, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name, sql FROM sqlite_master WHERE sql IS NOT NULL AND "+where)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objs []schemaObject
+	for rows.Next() {
+		var o schemaObject
+		if err = rows.Scan(&o.name, &o.sql); err != nil {
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	return objs, rows.Err()
+}
+
+// dumpRows writes an INSERT statement for each row of table to w. The values are written by
+// SQLite's quote(), as the sqlite3 shell does, so that they keep their storage class: the driver
+// would read an integral REAL as an integer.
+func dumpRows(ctx context.Context, conn *sql.Conn, w *stickyWriter, table string) error {
+	cols, err := conn.QueryContext(ctx, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return err
+	}
+	var exprs []string
+	for cols.Next() {
+		var name string
+		if err = cols.Scan(&name); err != nil {
+			cols.Close()
+			return err
+		}
+		exprs = append(exprs, "quote("+quoteIdent(name)+")")
+	}
+	cols.Close()
+	if err = cols.Err(); err != nil {
+		return err
+	}
+	if len(exprs) == 0 {
+		return nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT "+strings.Join(exprs, "||','||")+" FROM "+quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	prefix := "INSERT INTO " + quoteIdent(table) + " VALUES("
+	for rows.Next() {
+		var values string
+		if err = rows.Scan(&values); err != nil {
+			return err
+		}
+		// line breaks can only be inside string literals
+		w.WriteString(prefix + lineBreaks.Replace(values) + ");\n")
+		if w.err != nil {
+			return w.err
+		}
+	}
+	return rows.Err()
+}
+
+// lineBreaks replaces the line breaks inside string literals with char() calls, so that each
+// statement of a dump takes a single line.
+var lineBreaks = strings.NewReplacer("\n", "'||char(10)||'", "\r", "'||char(13)||'")
+
+// quoteString quotes s as an SQL string literal. Line breaks are written as char() calls, so that
+// each statement of a dump takes a single line.
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'':
+			b.WriteString("''")
+		case '\n', '\r':
+			fmt.Fprintf(&b, "'||char(%d)||'", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// quoteIdent quotes name for use as an identifier in SQL.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Restore runs the SQL text read from r on conn a statement at a time, e.g. to load a dump
+// written by Dump or the .dump command of the sqlite3 shell. If a statement fails, the
+// transaction it is part of, if any, is rolled back.
+func Restore(ctx context.Context, conn *sql.Conn, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var query strings.Builder
+	line, start := 0, 1
+	for {
+		text, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		line++
+		query.WriteString(text)
+		if sqlComplete(query.String()) || (rerr == io.EOF && strings.TrimSpace(query.String()) != "") {
+			if _, err := conn.ExecContext(ctx, query.String()); err != nil {
+				// leave the connection usable, there may be no transaction to roll back
+				conn.ExecContext(context.Background(), "ROLLBACK") //nolint:errcheck
+				return fmt.Errorf("line %d: %w", start, err)
+			}
+			query.Reset()
+			start = line + 1
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// sqlComplete reports whether query ends with a complete statement, the way sqlite3_complete
+// does: it ends with a semicolon outside of literals and comments, and statements creating
+// triggers with "; END;".
+func sqlComplete(query string) bool {
+	var stmt []string // the first tokens of the current statement
+	var prev1, prev2 string
+	trigger, ended := false, false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		var tok string
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			continue
+		case strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				return ended
+			}
+			i += j
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return false
+			}
+			i += j + 3
+			continue
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(query[i+1:], end)
+			if j < 0 {
+				return false
+			}
+			// a doubled quote is read as two literals, which doesn't change the outcome
+			i += j + 1
+			tok = "literal"
+		case c == '_' || c >= 0x80 || (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+			j := i + 1
+			for j < len(query) && (query[j] == '_' || query[j] == '$' || query[j] >= 0x80 ||
+				(query[j] >= '0' && query[j] <= '9') || (query[j]|0x20 >= 'a' && query[j]|0x20 <= 'z')) {
+				j++
+			}
+			tok = strings.ToUpper(query[i:j])
+			i = j - 1
+		default:
+			tok = string(c)
+		}
+		if ended {
+			stmt, trigger, ended = stmt[:0], false, false
+		}
+		if len(stmt) < 3 {
+			stmt = append(stmt, tok)
+			trigger = len(stmt) >= 2 && stmt[0] == "CREATE" && (stmt[1] == "TRIGGER" ||
+				len(stmt) == 3 && (stmt[1] == "TEMP" || stmt[1] == "TEMPORARY") && stmt[2] == "TRIGGER")
+		}
+		ended = tok == ";" && (!trigger || prev1 == "END" && prev2 == ";")
+		prev2, prev1 = prev1, tok
+	}
+	return ended
+}
@@ -0,0 +1,94 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// PlanNode is a step of a query plan, as reported by EXPLAIN QUERY PLAN.
+type PlanNode struct {
+	ID       int
+	Parent   int // the ID of the parent step, or 0 at the top level
+	Detail   string
+	Children []*PlanNode
+}
+
+// ExplainQueryPlan returns the query plan SQLite chooses for query with args, as a tree of
+// steps in the order of EXPLAIN QUERY PLAN.
+func ExplainQueryPlan(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) ([]*PlanNode, error) {
+	rows, err := conn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var nodes []*PlanNode
+	for rows.Next() {
+		var n PlanNode
+		var notused int
+		if err = rows.Scan(&n.ID, &n.Parent, &notused, &n.Detail); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, &n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return planTree(nodes), nil
+}
+
+// planTree links nodes, in the order of EXPLAIN QUERY PLAN, to their parents, returning the
+// top-level ones.
+func planTree(nodes []*PlanNode) []*PlanNode {
+	byID := make(map[int]*PlanNode, len(nodes))
+	var roots []*PlanNode
+	for _, n := range nodes {
+		if p := byID[n.Parent]; p != nil {
+			p.Children = append(p.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+		byID[n.ID] = n
+	}
+	return roots
+}
+
+// hasFullScan reports whether a step of the plan scans a table without an index.
+func hasFullScan(nodes []*PlanNode) bool {
+	for _, n := range nodes {
+		if strings.HasPrefix(n.Detail, "SCAN ") && !strings.Contains(n.Detail, " INDEX ") &&
+			!strings.HasPrefix(n.Detail, "SCAN CONSTANT ROW") || hasFullScan(n.Children) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatPlan formats the plan as a tree, like the sqlite3 shell does.
+func formatPlan(nodes []*PlanNode) string {
+	var b strings.Builder
+	b.WriteString("QUERY PLAN")
+	var format func(nodes []*PlanNode, indent string)
+	format = func(nodes []*PlanNode, indent string) {
+		for i, n := range nodes {
+			branch, next := "|--", "|  "
+			if i == len(nodes)-1 {
+				branch, next = "`--", "   "
+			}
+			b.WriteString("\n" + indent + branch + n.Detail)
+			format(n.Children, indent+next)
+		}
+	}
+	format(nodes, "")
+	return b.String()
+}
+
+// SlowPlanOptions configures the logging of the query plans of slow statements.
+type SlowPlanOptions struct {
+	// Threshold is the time above which a statement is slow: the time to run an exec, or
+	// between starting a query and reading the end of its rows. Zero disables it.
+	Threshold time.Duration
+	// FullScans also counts statements which scanned a table without an index as slow.
+	FullScans bool
+}
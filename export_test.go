@@ -0,0 +1,14 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+// SwapDefaultBackend sets the backend of the drivers registered by default, returning the one
+// it replaces, so that Init can be tested in isolation.
+func SwapDefaultBackend(b Backend) Backend {
+	defaultBackendMu.Lock()
+	defer defaultBackendMu.Unlock()
+	old := defaultBackend
+	defaultBackend = b
+	return old
+}
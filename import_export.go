@@ -0,0 +1,464 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is a format of ExportQuery and ImportTable.
+type Format int
+
+const (
+	// CSV has a header row of column names followed by a record per row. NULL is written as an
+	// empty field and blobs in base64, and empty fields are imported as NULL.
+	CSV Format = iota
+	// NDJSON (JSON Lines) has a JSON object per row, keyed by column name. Blobs are written in
+	// base64, and nested objects and arrays are imported as JSON text.
+	NDJSON
+)
+
+func (f Format) String() string {
+	switch f {
+	case CSV:
+		return "CSV"
+	case NDJSON:
+		return "NDJSON"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ExportQuery runs query with args on conn and writes its rows to w in format, e.g. to let users
+// download their data.
+func ExportQuery(ctx context.Context, conn *sql.Conn, query string, format Format, w io.Writer, args ...interface{}) error {
+	if format != CSV && format != NDJSON {
+		return fmt.Errorf("unknown format %s", format)
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	sw := &stickyWriter{w: bufio.NewWriter(w)}
+	cw := csv.NewWriter(sw.w)
+	record := make([]string, len(cols))
+	if format == CSV {
+		if err = cw.Write(cols); err != nil {
+			return err
+		}
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return err
+		}
+		if format == CSV {
+			for i, v := range values {
+				record[i] = csvField(v)
+			}
+			err = cw.Write(record)
+		} else {
+			err = writeJSONRow(sw, cols, values)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return sw.Flush()
+}
+
+// csvField returns the CSV field for a value read by database/sql.
+func csvField(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// writeJSONRow writes the row of values of cols to w as a JSON object on a line of its own.
+func writeJSONRow(w *stickyWriter, cols []string, values []interface{}) error {
+	w.WriteString("{")
+	for i, v := range values {
+		if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			v = nil
+		}
+		key, err := json.Marshal(cols[i])
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			w.WriteString(",")
+		}
+		w.Write(key)
+		w.WriteString(":")
+		w.Write(value)
+	}
+	w.WriteString("}\n")
+	return w.err
+}
+
+// ImportOptions are the options of ImportTable.
+type ImportOptions struct {
+	// Columns maps the fields of the input, i.e. CSV header names or JSON keys, to the columns of
+	// the table. Fields mapped to "" are skipped. Other fields are imported into the column of
+	// the same name, ignoring case, and it is an error if there is none.
+	Columns map[string]string
+	// Fields names the fields of CSV input which has no header row.
+	Fields []string
+}
+
+// importBatchSize is the number of rows ImportTable inserts in a single BulkInsert.
+const importBatchSize = 256
+
+// ImportTable reads rows in format from r and inserts them into table on conn, returning the
+// number of rows inserted. The rows are inserted in batches, with BulkInsert for connections of
+// this driver, inside a single savepoint, so that either all or none of them are. Strings
+// imported into columns declared as BLOB are decoded from base64, as ExportQuery writes blobs.
+func ImportTable(ctx context.Context, conn *sql.Conn, table string, format Format, r io.Reader, opts *ImportOptions) (n int64, err error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	columns, err := tableColumns(ctx, conn, table)
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("no such table: %s", table)
+	}
+	column := func(field string) (importColumn, error) {
+		name, ok := opts.Columns[field]
+		if !ok {
+			name = field
+		}
+		if name == "" {
+			return importColumn{}, nil
+		}
+		if col, ok := columns[strings.ToLower(name)]; ok {
+			return col, nil
+		}
+		return importColumn{}, fmt.Errorf("no column of %s for field %q", table, field)
+	}
+
+	if _, err = conn.ExecContext(ctx, "SAVEPOINT go_sqlite_import"); err != nil {
+		return 0, err
+	}
+	ins := &importer{ctx: ctx, conn: conn, table: table, stmts: make(map[string]*sql.Stmt)}
+	defer func() {
+		if err == nil {
+			err = ins.flush()
+		}
+		if cerr := ins.close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			_, err = conn.ExecContext(ctx, "RELEASE go_sqlite_import")
+		} else {
+			conn.ExecContext(context.Background(), "ROLLBACK TO go_sqlite_import; RELEASE go_sqlite_import") //nolint:errcheck
+			n = 0
+		}
+	}()
+
+	switch format {
+	case CSV:
+		ins.unit = "record"
+		cr := csv.NewReader(r)
+		cr.ReuseRecord = true
+		line := 1
+		fields := opts.Fields
+		if fields == nil {
+			header, err := cr.Read()
+			if err != nil {
+				return 0, err
+			}
+			fields = append([]string(nil), header...)
+			line++
+		}
+		cr.FieldsPerRecord = len(fields)
+		// the indexes of the fields which aren't skipped, and their columns
+		var keep []int
+		var cols []importColumn
+		for i, f := range fields {
+			col, err := column(f)
+			if err != nil {
+				return 0, err
+			}
+			if col.name != "" {
+				keep = append(keep, i)
+				cols = append(cols, col)
+			}
+		}
+		for ; ; line++ {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+			values := make([]driver.Value, len(keep))
+			for i, j := range keep {
+				if record[j] == "" {
+					continue
+				}
+				if values[i], err = cols[i].value(record[j]); err != nil {
+					return n, fmt.Errorf("record %d: %w", line, err)
+				}
+			}
+			if err = ins.insert(line, cols, values); err != nil {
+				return n, err
+			}
+			n++
+		}
+	case NDJSON:
+		ins.unit = "line"
+		br := bufio.NewReader(r)
+		for line := 1; ; line++ {
+			text, rerr := br.ReadBytes('\n')
+			if rerr != nil && rerr != io.EOF {
+				return n, rerr
+			}
+			if len(strings.TrimSpace(string(text))) != 0 {
+				if err = importJSONRow(ins, line, text, column); err != nil {
+					return n, err
+				}
+				n++
+			}
+			if rerr == io.EOF {
+				return n, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown format %s", format)
+}
+
+// importJSONRow inserts the JSON object text on line, with its keys mapped to columns by column.
+func importJSONRow(ins *importer, line int, text []byte, column func(field string) (importColumn, error)) error {
+	d := json.NewDecoder(strings.NewReader(string(text)))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return fmt.Errorf("line %d: %w", line, err)
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	// the same keys in any order share a statement
+	sort.Strings(keys)
+	var cols []importColumn
+	var values []driver.Value
+	for _, k := range keys {
+		col, err := column(k)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if col.name == "" {
+			continue
+		}
+		var v driver.Value
+		if str, ok := obj[k].(string); ok {
+			v, err = col.value(str)
+		} else {
+			v, err = jsonValue(obj[k])
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		cols = append(cols, col)
+		values = append(values, v)
+	}
+	return ins.insert(line, cols, values)
+}
+
+// jsonValue converts a value decoded from JSON with UseNumber to a value SQLite can store.
+func jsonValue(v interface{}) (driver.Value, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return v, nil
+}
+
+// importColumn is a column of the table ImportTable inserts into.
+type importColumn struct {
+	name string
+	blob bool // declared as BLOB, so strings are decoded from base64
+}
+
+// value returns the value stored in col for the string field.
+func (col importColumn) value(field string) (driver.Value, error) {
+	if !col.blob {
+		return field, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(field)
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", col.name, err)
+	}
+	return b, nil
+}
+
+// tableColumns returns the columns of table by their lower case names.
+func tableColumns(ctx context.Context, conn *sql.Conn, table string) (map[string]importColumn, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]importColumn)
+	for rows.Next() {
+		var name, typ string
+		if err = rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = importColumn{name: name, blob: strings.Contains(strings.ToUpper(typ), "BLOB")}
+	}
+	return columns, rows.Err()
+}
+
+// bulkInserter is implemented by the driver connections of this package in js/wasm.
+type bulkInserter interface {
+	BulkInsert(ctx context.Context, query string, rows [][]driver.Value) (driver.Result, error)
+}
+
+// importer inserts rows into a table, buffering consecutive rows with the same columns to insert
+// them in a batch.
+type importer struct {
+	ctx   context.Context
+	conn  *sql.Conn
+	table string
+	unit  string // what the input lines are called in errors, e.g. "record"
+
+	query string           // inserting the columns of the buffered rows
+	rows  [][]driver.Value // buffered
+	lines []int            // of the buffered rows
+
+	stmts map[string]*sql.Stmt // by query, for drivers without BulkInsert
+}
+
+// insert inserts the row of values into cols, read from line of the input.
+func (ins *importer) insert(line int, cols []importColumn, values []driver.Value) error {
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = quoteIdent(col.name)
+	}
+	query := "INSERT INTO " + quoteIdent(ins.table) + " DEFAULT VALUES"
+	if len(cols) > 0 {
+		query = "INSERT INTO " + quoteIdent(ins.table) + "(" + strings.Join(quoted, ",") + ") VALUES(" +
+			strings.Repeat("?, ", len(cols)-1) + "?)"
+	}
+	if query != ins.query || len(ins.rows) >= importBatchSize {
+		if err := ins.flush(); err != nil {
+			return err
+		}
+		ins.query = query
+	}
+	ins.rows = append(ins.rows, values)
+	ins.lines = append(ins.lines, line)
+	return nil
+}
+
+// flush inserts the buffered rows, with BulkInsert if the driver has it. If the batch fails,
+// its rows are inserted one by one to report the line which failed.
+func (ins *importer) flush() error {
+	if len(ins.rows) == 0 {
+		return nil
+	}
+	rows, lines := ins.rows, ins.lines
+	ins.rows, ins.lines = nil, nil
+	bulk := false
+	err := ins.conn.Raw(func(driverConn interface{}) error {
+		bi, ok := driverConn.(bulkInserter)
+		if !ok {
+			return nil
+		}
+		_, err := bi.BulkInsert(ins.ctx, ins.query, rows)
+		bulk = err == nil
+		return nil
+	})
+	if err != nil || bulk {
+		return err
+	}
+	stmt := ins.stmts[ins.query]
+	if stmt == nil {
+		if stmt, err = ins.conn.PrepareContext(ins.ctx, ins.query); err != nil {
+			return fmt.Errorf("%s %d: %w", ins.unit, lines[0], err)
+		}
+		ins.stmts[ins.query] = stmt
+	}
+	args := make([]interface{}, 0, len(rows[0]))
+	for i, row := range rows {
+		args = args[:0]
+		for _, v := range row {
+			args = append(args, v)
+		}
+		if _, err = stmt.ExecContext(ins.ctx, args...); err != nil {
+			return fmt.Errorf("%s %d: %w", ins.unit, lines[i], err)
+		}
+	}
+	return nil
+}
+
+// close closes the prepared statements.
+func (ins *importer) close() error {
+	var err error
+	for _, stmt := range ins.stmts {
+		if cerr := stmt.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
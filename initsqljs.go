@@ -0,0 +1,101 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall/js"
+)
+
+// Init loads sql.js for the drivers registered by default, by calling initSqlJs and waiting for
+// the module it resolves to. initSqlJs is taken from the global of that name, as defined by
+// sql-wasm.js, or else required from the "sql.js" package where require is available. Once
+// Init returns successfully databases can be opened without setting the _go_sqlite global;
+// later calls do nothing.
+//
+// Init blocks the calling goroutine while the JS event loop carries on, so it must not be
+// called from a js.Func.
+func Init(ctx context.Context, cfg Config) error {
+	defaultBackendMu.Lock()
+	initialized := defaultBackend != nil
+	defaultBackendMu.Unlock()
+	if initialized {
+		return nil
+	}
+
+	initSqlJs := js.Global().Get("initSqlJs")
+	if initSqlJs.Type() != js.TypeFunction {
+		if require := js.Global().Get("require"); require.Type() == js.TypeFunction {
+			initSqlJs, _ = jsTryCatch(func() js.Value { return require.Invoke("sql.js") })
+		}
+	}
+	if initSqlJs.Type() != js.TypeFunction {
+		return errors.New("sql.js isn't loaded: initSqlJs isn't defined")
+	}
+
+	var funcs []js.Func
+	release := func() {
+		for _, f := range funcs {
+			f.Release()
+		}
+	}
+	jsCfg := map[string]interface{}{}
+	if cfg.WasmBytes != nil {
+		wasm := js.Global().Get("Uint8Array").New(len(cfg.WasmBytes))
+		js.CopyBytesToJS(wasm, cfg.WasmBytes)
+		jsCfg["wasmBinary"] = wasm
+	} else if cfg.WasmURL != "" {
+		locateFile := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			return cfg.WasmURL
+		})
+		funcs = append(funcs, locateFile)
+		jsCfg["locateFile"] = locateFile
+	}
+
+	type result struct {
+		module js.Value
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	onLoad := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resultCh <- result{module: args[0]}
+		return nil
+	})
+	onError := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resultCh <- result{err: jsException(args[0])}
+		return nil
+	})
+	funcs = append(funcs, onLoad, onError)
+	_, err := jsTryCatch(func() js.Value {
+		return initSqlJs.Invoke(jsCfg).Call("then", onLoad, onError)
+	})
+	if err != nil {
+		release()
+		return fmt.Errorf("initSqlJs: %s", err)
+	}
+
+	var res result
+	select {
+	case res = <-resultCh:
+		release()
+	case <-ctx.Done():
+		// the promise can't be canceled, so the callbacks must outlive it
+		go func() {
+			<-resultCh
+			release()
+		}()
+		return ctx.Err()
+	}
+	if res.err != nil {
+		return fmt.Errorf("initSqlJs: %s", res.err)
+	}
+	defaultBackendMu.Lock()
+	defer defaultBackendMu.Unlock()
+	if defaultBackend == nil {
+		defaultBackend = NewSQLJSBackend(res.module)
+	}
+	return nil
+}
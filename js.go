@@ -1,56 +1,84 @@
+//go:build js && wasm
+// +build js,wasm
+
 package sqlite3_js //nolint:golint
 
 import (
+	"errors"
 	"fmt"
-	"os"
 	"runtime/debug"
 	"syscall/js"
 )
 
 const (
-	// The name of the global where sql.js has been loaded. This is the `SQL` var of:
+	// The name of the global where sql.js has been loaded for the drivers registered by
+	// default. This is the `SQL` var of:
 	//     const initSqlJs = require('sql.js');
 	//     const SQL = await initSqlJs({ ...})
+	// Drivers returned by NewDriver use their own module instead.
 	globalSQLJS = "_go_sqlite"
 
-	// The name of the global where sql.js should store its databases. This is purely
-	// for debugging as JS-land doesn't ever read this map, but Go stores databases here.
-	// The value of this global is an empty Map. It is crucial this isn't an empty object
-	// else database names like 'hasOwnProperty' will fail due to it existing but
-	// not being a database object!
+	// The name of the global where Go stores the sql.js databases opened by the default
+	// drivers, if it is set to a Map. A database JS puts in the map before it is first
+	// opened, e.g. a sql.js Database loaded from a file, is used instead of an empty one.
+	// It is crucial this is a Map and not an empty object, else database names like
+	// 'hasOwnProperty' would clash with its properties.
 	globalSQLDBs = "_go_sqlite_dbs"
 )
 
-// jsEnsureGlobal is a helper function to set-if-not-exists and return whether the global existed.
-func jsEnsureGlobal(globalName string, defaultVal *js.Value) (existed bool) {
-	v := js.Global().Get(globalName)
-	if v.Truthy() {
-		return true
-	}
-	if defaultVal != nil {
-		js.Global().Set(globalName, *defaultVal)
-		v = *defaultVal
-	}
-	return false
-}
-
 // jsTryCatch is a helper function that catches exceptions/panics thrown by fn and returns them as error.
 // This is useful for calling JS functions which can throw.
 func jsTryCatch(fn func() js.Value) (val js.Value, err error) {
 	defer func() {
 		if e := recover(); e != nil {
+			if jsErr, ok := e.(js.Error); ok {
+				err = jsException(jsErr.Value)
+				return
+			}
 			err = fmt.Errorf("exception: %s", e)
 		}
 	}()
 	return fn(), nil
 }
 
-// protect is a helper function which guards against panics, setting an error when it happens.
-func protect(name string, setError func(error)) {
-	err := recover()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s panicked: %s\n", name, err)
-		debug.PrintStack()
-		setError(fmt.Errorf("%s panicked: %s", name, err))
+// jsError is an exception thrown by a JS function.
+type jsError struct {
+	msg  string
+	code int // SQLite result code carried by the exception, e.g. by oo1's SQLite3Error, or 0
+}
+
+func (e *jsError) Error() string {
+	return "exception: " + e.msg
+}
+
+// jsException returns the value thrown by a JS function as an error.
+func jsException(thrown js.Value) error {
+	if jsTypeOf(thrown) != "object" {
+		// js.Error can only describe thrown objects, but e.g. sql.js throws strings
+		return &jsError{msg: js.Global().Get("String").Invoke(thrown).String()}
+	}
+	e := &jsError{msg: js.Error{Value: thrown}.Error()}
+	if code := thrown.Get("resultCode"); code.Type() == js.TypeNumber {
+		e.code = code.Int()
+	}
+	return e
+}
+
+// errorCode returns the SQLite result code carried by err, if any.
+func errorCode(err error) (int, bool) {
+	var e *jsError
+	if errors.As(err, &e) && e.code != 0 {
+		return e.code, true
+	}
+	return 0, false
+}
+
+// protect is a helper function which guards against panics, logging them to l and setting an
+// error when it happens.
+func protect(l Logger, name string, setError func(error)) {
+	if r := recover(); r != nil {
+		err := fmt.Errorf("%s panicked: %s", name, r)
+		logEvent(l, LogError, "panic", LogField{FieldOp, name}, LogField{FieldError, err}, LogField{FieldStack, string(debug.Stack())})
+		setError(err)
 	}
 }
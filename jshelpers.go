@@ -0,0 +1,253 @@
+//go:build js && wasm
+// +build js,wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"sync"
+	"syscall/js"
+)
+
+// jsHelpersSource is compiled once into a function which, given the JS adapter of a backend (see
+// backend_js.go), returns an object of JS helper functions built on that adapter. The helpers do
+// work which would otherwise take many calls across the Go/JS boundary.
+const jsHelpersSource = `
+"use strict";
+
+var storageClasses = [null, "INTEGER", "REAL", "TEXT", "BLOB", "NULL"];
+
+function storageClass(v) {
+	if (v === null || v === undefined) {
+		return "NULL";
+	}
+	switch (typeof v) {
+	case "number":
+		return Number.isInteger(v) ? "INTEGER" : "REAL";
+	case "bigint":
+		return "INTEGER";
+	case "string":
+		return "TEXT";
+	}
+	return "BLOB";
+}
+
+// tableColumnMetadata returns the declared type and NOT NULL constraint of a column, using
+// sqlite3_table_column_metadata if the adapter reaches it and table_info otherwise.
+function tableColumnMetadata(db, schema, table, column) {
+	var meta = A.tableColumnMetadata(db, schema, table, column);
+	if (meta !== null) {
+		return meta;
+	}
+	var row = A.selectRow(db, 'SELECT type, "notnull" FROM pragma_table_info(?, ?) WHERE name = ?', [table, schema === null ? "main" : schema, column]);
+	if (row === null) {
+		return null;
+	}
+	return {
+		decltype: row[0],
+		notnull: row[1] !== 0,
+	};
+}
+
+// columnTypes describes the result columns of stmt: the declared type and NOT NULL constraint of
+// the column each one comes from, and the storage class of its value in the current row if hasRow.
+function columnTypes(db, stmt, hasRow) {
+	var names = A.columnNames(stmt);
+	var row = null;
+	var out = [];
+	for (var i = 0; i < names.length; i++) {
+		var col = {
+			decltype: A.columnString(stmt, "decltype", i),
+			notnull: null,
+			storage: null,
+		};
+		var table = A.columnString(stmt, "table_name", i);
+		var origin = A.columnString(stmt, "origin_name", i);
+		if (table !== null && origin !== null) {
+			var meta = tableColumnMetadata(db, A.columnString(stmt, "database_name", i), table, origin);
+			if (meta !== null) {
+				col.decltype = col.decltype === null ? meta.decltype : col.decltype;
+				col.notnull = meta.notnull;
+			}
+		}
+		if (hasRow) {
+			var t = A.columnType(stmt, i);
+			if (t > 0) {
+				col.storage = storageClasses[t] || null;
+			} else {
+				row = row === null ? A.get(stmt) : row;
+				col.storage = storageClass(row[i]);
+			}
+		}
+		out.push(col);
+	}
+	return out;
+}
+
+// Tags of the values packed by fetchRows, see rowBatch.
+var TAG_NULL = 0, TAG_INTEGER = 1, TAG_REAL = 2, TAG_TEXT = 3, TAG_BLOB = 4, TAG_OTHER = 5, TAG_INT64 = 6;
+
+var textEncoder = new TextEncoder();
+
+// RowWriter packs values into a growable buffer.
+function RowWriter() {
+	this.buf = new Uint8Array(4096);
+	this.view = new DataView(this.buf.buffer);
+	this.len = 0;
+	this.others = [];
+}
+
+RowWriter.prototype.ensure = function(n) {
+	if (this.len + n <= this.buf.length) {
+		return;
+	}
+	var size = this.buf.length * 2;
+	while (size < this.len + n) {
+		size *= 2;
+	}
+	var buf = new Uint8Array(size);
+	buf.set(this.buf.subarray(0, this.len));
+	this.buf = buf;
+	this.view = new DataView(buf.buffer);
+};
+
+RowWriter.prototype.value = function(v) {
+	if (v === null || v === undefined) {
+		this.ensure(1);
+		this.buf[this.len++] = TAG_NULL;
+	} else if (typeof v === "number") {
+		this.ensure(9);
+		this.buf[this.len++] = Number.isSafeInteger(v) ? TAG_INTEGER : TAG_REAL;
+		this.view.setFloat64(this.len, v, true);
+		this.len += 8;
+	} else if (typeof v === "bigint" && BigInt.asIntN(64, v) === v) {
+		this.ensure(9);
+		this.buf[this.len++] = TAG_INT64;
+		this.view.setBigInt64(this.len, v, true);
+		this.len += 8;
+	} else if (typeof v === "string") {
+		this.ensure(5 + v.length * 3);
+		this.buf[this.len] = TAG_TEXT;
+		var n = textEncoder.encodeInto(v, this.buf.subarray(this.len + 5)).written;
+		this.view.setUint32(this.len + 1, n, true);
+		this.len += 5 + n;
+	} else if (v instanceof Uint8Array) {
+		this.ensure(5 + v.length);
+		this.buf[this.len] = TAG_BLOB;
+		this.view.setUint32(this.len + 1, v.length, true);
+		this.buf.set(v, this.len + 5);
+		this.len += 5 + v.length;
+	} else {
+		// left for Go to decode from the JS value itself
+		this.ensure(5);
+		this.buf[this.len] = TAG_OTHER;
+		this.view.setUint32(this.len + 1, this.others.length, true);
+		this.others.push(v);
+		this.len += 5;
+	}
+};
+
+RowWriter.prototype.row = function(row) {
+	for (var i = 0; i < row.length; i++) {
+		this.value(row[i]);
+	}
+};
+
+RowWriter.prototype.batch = function(count, more) {
+	return {
+		count: count,
+		more: more,
+		buf: this.buf.subarray(0, this.len),
+		others: this.others,
+	};
+};
+
+// fetchRows reads up to max rows from stmt, which must be positioned on a row, stepping
+// past each one. It returns the rows packed into a single buffer, and whether there are
+// more rows to fetch.
+function fetchRows(stmt, max) {
+	var w = new RowWriter();
+	var count = 0;
+	var more = true;
+	while (count < max && more) {
+		w.row(A.get(stmt));
+		count++;
+		more = A.step(stmt);
+	}
+	return w.batch(count, more);
+}
+
+// packRow packs the current row of stmt the way fetchRows does, without stepping past it.
+function packRow(stmt) {
+	var w = new RowWriter();
+	w.row(A.get(stmt));
+	return w.batch(1, false);
+}
+
+// lastResult returns the rowid of the last insert and the number of rows changed by the last
+// statement on db.
+function lastResult(db) {
+	return {
+		changes: A.changes(db),
+		id: A.lastInsertRowid(db),
+	};
+}
+
+// run runs stmt once with args, leaving it reset with its bindings cleared.
+function run(stmt, args) {
+	try {
+		A.bind(stmt, args);
+		A.step(stmt);
+	} finally {
+		A.reset(stmt);
+	}
+}
+
+// execStatement runs stmt with args, returning the rowid of the last insert and the number
+// of rows changed.
+function execStatement(db, stmt, args) {
+	run(stmt, args);
+	return lastResult(db);
+}
+
+// bulkExec runs stmt once for each row of rows inside a savepoint, which is rolled back if any
+// row fails. It returns the total number of rows changed and the rowid of the last insert.
+function bulkExec(db, stmt, rows) {
+	var changes = 0;
+	A.exec(db, "SAVEPOINT go_sqlite_bulk");
+	for (var i = 0; i < rows.length; i++) {
+		try {
+			run(stmt, rows[i]);
+		} catch (e) {
+			A.exec(db, "ROLLBACK TO go_sqlite_bulk; RELEASE go_sqlite_bulk");
+			throw new Error("row " + i + ": " + (e && e.message ? e.message : e));
+		}
+		changes += A.changes(db);
+	}
+	A.exec(db, "RELEASE go_sqlite_bulk");
+	return {
+		changes: changes,
+		id: A.lastInsertRowid(db),
+	};
+}
+
+return {
+	bulkExec: bulkExec,
+	columnTypes: columnTypes,
+	execStatement: execStatement,
+	fetchRows: fetchRows,
+	packRow: packRow,
+};
+`
+
+var (
+	jsHelpersOnce    sync.Once
+	jsHelpersFactory js.Value
+)
+
+// newJSHelpers returns the JS helper functions built on a backend adapter.
+func newJSHelpers(adapter js.Value) js.Value {
+	jsHelpersOnce.Do(func() {
+		jsHelpersFactory = js.Global().Get("Function").New("A", jsHelpersSource)
+	})
+	return jsHelpersFactory.Invoke(adapter)
+}
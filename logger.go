@@ -0,0 +1,65 @@
+package sqlite3_js //nolint:golint
+
+import "fmt"
+
+// LogLevel is the severity of a log event.
+type LogLevel int
+
+// Log levels, in increasing order of severity.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// LogField is a structured field of a log event.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Keys of the fields of log events.
+const (
+	FieldDSN       = "dsn"        // string
+	FieldSQL       = "sql"        // string
+	FieldDuration  = "duration"   // time.Duration
+	FieldError     = "error"      // error
+	FieldErrorCode = "error_code" // int SQLite result code, where the backend reports it
+	FieldOp        = "op"         // string name of the driver operation, e.g. "Exec"
+	FieldStack     = "stack"      // string stack trace of a panic
+	FieldPlan      = "plan"       // string query plan, formatted like the sqlite3 shell's .eqp
+)
+
+// Logger receives the log events of a driver, which are:
+//
+//	LogInfo "open" when a database is opened, or LogError if that fails
+//	LogDebug "exec" and "query" for each statement run, or LogWarn if it fails
+//	LogError "panic" when a panic is recovered from
+//	LogWarn "slow plan" with the plan of a slow statement, if SlowPlans is set
+//
+// Drivers without a Logger are silent.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// logEvent logs an event to l if set.
+func logEvent(l Logger, level LogLevel, msg string, fields ...LogField) {
+	if l != nil {
+		l.Log(level, msg, fields...)
+	}
+}
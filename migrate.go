@@ -0,0 +1,159 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Migration is a step of a schema migration, which brings the database from the version of the
+// previous step up to Version. The version of the database is kept in PRAGMA user_version.
+type Migration struct {
+	Version int
+	Name    string // for error messages
+	// SQL holds the statements of the step, which are run unless Func is set.
+	SQL string
+	// Func runs the step on conn, inside the transaction of the step.
+	Func func(ctx context.Context, conn *sql.Conn) error
+}
+
+// MigrateOptions are the options of Migrate.
+type MigrateOptions struct {
+	// Target is the version to migrate up to, or 0 for the latest.
+	Target int
+	// DryRun runs the pending steps in a single transaction and rolls it back, reporting the
+	// version they would bring the database to or the error they fail with.
+	DryRun bool
+	// Snapshot serializes the database with export() before applying any step, and restores it
+	// if a step fails, so that the migration is applied either in full or not at all. It only
+	// works with connections of this driver in js/wasm. With sql.js, export() frees the
+	// statements prepared on the database, failing any rows left open on other connections.
+	Snapshot bool
+}
+
+// Migrate applies the steps of migrations with versions above the version of the database up
+// to the target version, in order of version, each in a transaction of its own on conn. It
+// returns the version the database is at afterwards, or would be at for a dry run. Moving to
+// a version below that of the database isn't supported.
+func Migrate(ctx context.Context, conn *sql.Conn, migrations []Migration, opts *MigrateOptions) (version int, err error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	steps := append([]Migration(nil), migrations...)
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].Version < steps[j].Version
+	})
+	for i, m := range steps {
+		if m.Version <= 0 {
+			return 0, fmt.Errorf("%s: version %d isn't positive", m, m.Version)
+		}
+		if i > 0 && steps[i-1].Version == m.Version {
+			return 0, fmt.Errorf("%s and %s have the same version", steps[i-1], m)
+		}
+	}
+	if err = conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	target := opts.Target
+	if target == 0 && len(steps) > 0 {
+		target = steps[len(steps)-1].Version
+	}
+	if target < version {
+		return version, fmt.Errorf("the database is at version %d, above the target version %d", version, target)
+	}
+	var pending []Migration
+	for _, m := range steps {
+		if m.Version > version && m.Version <= target {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return version, nil
+	}
+
+	if opts.DryRun {
+		if _, err = conn.ExecContext(ctx, "BEGIN"); err != nil {
+			return version, err
+		}
+		defer func() {
+			if _, rerr := conn.ExecContext(context.Background(), "ROLLBACK"); err == nil {
+				err = rerr
+			}
+		}()
+		for _, m := range pending {
+			if err = m.run(ctx, conn); err != nil {
+				return version, err
+			}
+			version = m.Version
+		}
+		return version, nil
+	}
+
+	var restore func() error
+	if opts.Snapshot {
+		if restore, err = snapshotConn(conn); err != nil {
+			return version, fmt.Errorf("snapshot: %w", err)
+		}
+	}
+	start := version
+	for _, m := range pending {
+		if err = m.apply(ctx, conn); err != nil {
+			if restore == nil {
+				return version, err
+			}
+			if rerr := restore(); rerr != nil {
+				return version, fmt.Errorf("%w (restoring the snapshot: %s)", err, rerr)
+			}
+			return start, err
+		}
+		version = m.Version
+	}
+	return version, nil
+}
+
+func (m Migration) String() string {
+	if m.Name == "" {
+		return fmt.Sprintf("migration %d", m.Version)
+	}
+	return fmt.Sprintf("migration %d (%s)", m.Version, m.Name)
+}
+
+// apply runs the step and sets the version of the database in a transaction.
+func (m Migration) apply(ctx context.Context, conn *sql.Conn) (err error) {
+	if _, err = conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	if err = m.run(ctx, conn); err == nil {
+		if _, err = conn.ExecContext(ctx, "COMMIT"); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%s: %w", m, err)
+	}
+	if _, rerr := conn.ExecContext(context.Background(), "ROLLBACK"); rerr != nil {
+		err = fmt.Errorf("%w (rollback: %s)", err, rerr)
+	}
+	return err
+}
+
+// run runs the step and sets the version of the database.
+func (m Migration) run(ctx context.Context, conn *sql.Conn) error {
+	var err error
+	switch {
+	case m.Func != nil:
+		err = m.Func(ctx, conn)
+	case m.SQL != "":
+		_, err = conn.ExecContext(ctx, m.SQL)
+	default:
+		err = errors.New("neither SQL nor Func is set")
+	}
+	if err == nil {
+		// PRAGMA doesn't take placeholders
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", m.Version))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	return nil
+}
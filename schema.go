@@ -0,0 +1,242 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Schema describes the tables, views and triggers of a database, in order of name.
+type Schema struct {
+	Tables   []Table
+	Views    []View
+	Triggers []Trigger
+}
+
+// Table describes a table.
+type Table struct {
+	Name        string
+	SQL         string // the CREATE TABLE statement
+	Virtual     bool
+	Columns     []Column
+	Indexes     []Index // in order of name
+	ForeignKeys []ForeignKey
+}
+
+// Column describes a column of a table or view.
+type Column struct {
+	Name       string
+	Type       string // as declared, e.g. "VARCHAR(255)", or empty
+	NotNull    bool
+	Default    *string // the SQL text of the default value, or nil if there is none
+	PrimaryKey int     // the position of the column in the primary key from 1, or 0 if not part of it
+}
+
+// Index describes an index of a table.
+type Index struct {
+	Name    string
+	SQL     string // the CREATE INDEX statement, or empty for indexes created by constraints
+	Unique  bool
+	Origin  string   // "c" for CREATE INDEX, "u" for UNIQUE constraints and "pk" for PRIMARY KEY
+	Partial bool     // whether the index has a WHERE clause
+	Columns []string // the indexed columns in order, with empty names for expressions
+}
+
+// ForeignKey describes a foreign key of a table.
+type ForeignKey struct {
+	Table    string   // the referenced table
+	From     []string // the columns of the table
+	To       []string // the referenced columns, empty names referring to the primary key
+	OnUpdate string
+	OnDelete string
+	Match    string
+}
+
+// View describes a view.
+type View struct {
+	Name    string
+	SQL     string // the CREATE VIEW statement
+	Columns []Column
+}
+
+// Trigger describes a trigger.
+type Trigger struct {
+	Name  string
+	Table string // the table or view the trigger is on
+	SQL   string // the CREATE TRIGGER statement
+}
+
+// ReadSchema describes the schema of the database conn is connected to, from sqlite_master and
+// the table_info, index_list, index_info and foreign_key_list pragmas. SQLite's internal tables
+// are left out.
+func ReadSchema(ctx context.Context, conn *sql.Conn) (*Schema, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT type, name, tbl_name, IFNULL(sql, '') FROM sqlite_master "+
+		"WHERE type IN ('table', 'view', 'trigger') AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	type object struct {
+		typ, name, table, sql string
+	}
+	var objs []object
+	for rows.Next() {
+		var o object
+		if err = rows.Scan(&o.typ, &o.name, &o.table, &o.sql); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s := &Schema{}
+	for _, o := range objs {
+		switch o.typ {
+		case "table":
+			t, err := readTable(ctx, conn, o.name, o.sql)
+			if err != nil {
+				return nil, err
+			}
+			s.Tables = append(s.Tables, *t)
+		case "view":
+			cols, err := readColumns(ctx, conn, o.name)
+			if err != nil {
+				return nil, err
+			}
+			s.Views = append(s.Views, View{Name: o.name, SQL: o.sql, Columns: cols})
+		case "trigger":
+			s.Triggers = append(s.Triggers, Trigger{Name: o.name, Table: o.table, SQL: o.sql})
+		}
+	}
+	return s, nil
+}
+
+// ReadTable describes the table called name of the database conn is connected to.
+func ReadTable(ctx context.Context, conn *sql.Conn, name string) (*Table, error) {
+	var sqlText string
+	err := conn.QueryRowContext(ctx, "SELECT IFNULL(sql, '') FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&sqlText)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no such table: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(ctx, conn, name, sqlText)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readTable describes the table called name, created by sqlText.
+func readTable(ctx context.Context, conn *sql.Conn, name, sqlText string) (*Table, error) {
+	t := &Table{Name: name, SQL: sqlText}
+	t.Virtual = strings.HasPrefix(strings.ToUpper(sqlText), "CREATE VIRTUAL")
+	var err error
+	if t.Columns, err = readColumns(ctx, conn, name); err != nil {
+		return nil, err
+	}
+	if t.Indexes, err = readIndexes(ctx, conn, name); err != nil {
+		return nil, err
+	}
+	if t.ForeignKeys, err = readForeignKeys(ctx, conn, name); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readColumns describes the columns of the table or view called name.
+func readColumns(ctx context.Context, conn *sql.Conn, name string) ([]Column, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []Column
+	for rows.Next() {
+		var c Column
+		var dflt sql.NullString
+		if err = rows.Scan(&c.Name, &c.Type, &c.NotNull, &dflt, &c.PrimaryKey); err != nil {
+			return nil, err
+		}
+		if dflt.Valid {
+			c.Default = &dflt.String
+		}
+		cols = append(cols, c)
+	}
+	return cols, rows.Err()
+}
+
+// readIndexes describes the indexes of the table called name.
+func readIndexes(ctx context.Context, conn *sql.Conn, name string) ([]Index, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT l.name, IFNULL(m.sql, ''), l."unique", l.origin, l.partial `+
+		`FROM pragma_index_list(?) AS l LEFT JOIN sqlite_master AS m ON m.type = 'index' AND m.name = l.name ORDER BY l.name`, name)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []Index
+	for rows.Next() {
+		var idx Index
+		if err = rows.Scan(&idx.Name, &idx.SQL, &idx.Unique, &idx.Origin, &idx.Partial); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		indexes = append(indexes, idx)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range indexes {
+		cols, err := conn.QueryContext(ctx, "SELECT IFNULL(name, '') FROM pragma_index_info(?) ORDER BY seqno", indexes[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		for cols.Next() {
+			var col string
+			if err = cols.Scan(&col); err != nil {
+				cols.Close()
+				return nil, err
+			}
+			indexes[i].Columns = append(indexes[i].Columns, col)
+		}
+		cols.Close()
+		if err = cols.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
+
+// readForeignKeys describes the foreign keys of the table called name.
+func readForeignKeys(ctx context.Context, conn *sql.Conn, name string) ([]ForeignKey, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT id, "table", "from", IFNULL("to", ''), on_update, on_delete, "match" `+
+		`FROM pragma_foreign_key_list(?) ORDER BY id, seq`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []ForeignKey
+	lastID := -1
+	for rows.Next() {
+		var id int
+		var fk ForeignKey
+		var from, to string
+		if err = rows.Scan(&id, &fk.Table, &from, &to, &fk.OnUpdate, &fk.OnDelete, &fk.Match); err != nil {
+			return nil, err
+		}
+		// a row per column of each foreign key
+		if id != lastID {
+			fks = append(fks, fk)
+			lastID = id
+		}
+		last := &fks[len(fks)-1]
+		last.From = append(last.From, from)
+		last.To = append(last.To, to)
+	}
+	return fks, rows.Err()
+}
@@ -1,3 +1,6 @@
+//go:build js && wasm
+// +build js,wasm
+
 // -*- coding: utf-8 -*-
 // Copyright 2020 The Matrix.org Foundation C.I.C.
 //
@@ -21,28 +24,57 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall/js"
+	"time"
 )
 
 func init() {
+	sql.Register(DriverName, &SqliteJsDriver{})
+	// also registered under the name it had before DriverName, which only works in WASM as
+	// native SQLite drivers use it
 	sql.Register("sqlite3", &SqliteJsDriver{})
-	dbMap := js.Global().Get("Map").New()
-	jsEnsureGlobal(globalSQLDBs, &dbMap)
-	exists := jsEnsureGlobal(globalSQLJS, nil)
-	if !exists {
-		panic(globalSQLJS + " must be set a global variable in JS")
+}
+
+// NewDriver returns a driver opening databases with the sql.js module sqlModule, as returned by
+// initSqlJs, instead of the one in the _go_sqlite global. Drivers don't share databases, even
+// with the same name, so several sql.js builds can be used side by side.
+func NewDriver(sqlModule js.Value) *SqliteJsDriver {
+	return &SqliteJsDriver{
+		Backend: NewSQLJSBackend(sqlModule),
 	}
 }
 
+// Register registers NewDriver(sqlModule) with database/sql under name, and returns it. Like
+// sql.Register, it panics if name is already registered.
+func Register(name string, sqlModule js.Value) *SqliteJsDriver {
+	d := NewDriver(sqlModule)
+	sql.Register(name, d)
+	return d
+}
+
 // SqliteJsDriver implements driver.Driver.
 type SqliteJsDriver struct {
 	ConnectHook func(*SqliteJsConn) error
+	// Logger receives the log events of the driver. If nil, the driver is silent.
+	Logger Logger
+	// Tracer traces the statements run by the driver, if set.
+	Tracer Tracer
+	// SlowPlans, if set, makes the driver log the query plan of slow statements to Logger.
+	SlowPlans *SlowPlanOptions
+	// Backend opens the databases. If nil, sql.js is used with the module loaded by Init or
+	// else the one in the _go_sqlite global, which must be set by the time a database is
+	// opened. It must be comparable, as connections to the same name share a database per
+	// Backend.
+	Backend Backend
 }
 
 // SqliteJsTx implements driver.Tx.
@@ -52,37 +84,155 @@ type SqliteJsTx struct {
 
 // SqliteJsResult implements sql.Result.
 type SqliteJsResult struct {
-	js      js.Value
 	id      int64
 	changes int64
 }
 
 // SqliteJsRows implements driver.Rows.
 type SqliteJsRows struct {
-	s *SqliteJsStmt
-	// nc       int
-	// cols     []string
-	// decltype []string
+	s      *SqliteJsStmt
+	cols   []string     // lazily loaded by Columns
+	types  []columnType // lazily loaded by columnTypes
 	closed bool
 	cls    bool
 	ctx    context.Context // no better alternative to pass context into Next() method
+	tail   string          // the remaining statements of a conn-level query
+	args   []namedValue    // args left over for the remaining statements
+	bound  []driver.Value  // args of the current result set, for SlowPlans
+
+	trace    TraceEvent      // of the current result set, for the Tracer
+	traceCtx context.Context // returned by Tracer.OnQueryStart
+	start    time.Time
+	ended    bool // whether endResultSet was called for the current result set
+}
+
+// database is the state shared by all connections to the same database.
+type database struct {
+	schemaGen uint64 // bumped on schema changes to invalidate cached statements; accessed atomically
+	bdb       BackendDB
+
+	connsMu sync.Mutex
+	conns   map[*SqliteJsConn]struct{} // open connections, for DBStats
+}
+
+// databaseKey identifies a database by the backend which opened it, its name and VFS.
+type databaseKey struct {
+	backend Backend
+	name    string
+	vfs     string
+}
+
+var (
+	databasesMu sync.Mutex
+	databases   = make(map[databaseKey]*database)
+
+	defaultBackendMu sync.Mutex
+	defaultBackend   Backend
+)
+
+// globalBackend returns the sql.js backend for the module loaded by Init, or else the one in
+// the _go_sqlite global.
+func globalBackend() (Backend, error) {
+	defaultBackendMu.Lock()
+	defer defaultBackendMu.Unlock()
+	if defaultBackend == nil {
+		module := js.Global().Get(globalSQLJS)
+		if !module.Truthy() {
+			return nil, errors.New("sql.js isn't initialized: call Init, set " + globalSQLJS + " to the sql.js module, or use NewDriver")
+		}
+		defaultBackend = NewSQLJSBackend(module)
+	}
+	return defaultBackend, nil
 }
 
 // Open a database "connection" to a SQLite database.
 func (d *SqliteJsDriver) Open(dsn string) (conn driver.Conn, err error) {
-	dsn = strings.TrimPrefix(dsn, "file:")
-	defer protect("Open", func(e error) { err = e })
-	dbMap := js.Global().Get(globalSQLDBs)
-	jsDb := dbMap.Call("get", dsn)
-	if !jsDb.Truthy() {
-		jsDb = js.Global().Get(globalSQLJS).Get("Database").New(dsn)
-		dbMap.Call("set", dsn, jsDb)
-	}
-	fmt.Println("Open ->", dsn, "err=", err)
-	return &SqliteJsConn{
-		JsDb: jsDb,
+	fullDSN := dsn
+	defer func() {
+		if err != nil {
+			logEvent(d.Logger, LogError, "open", LogField{FieldDSN, fullDSN}, LogField{FieldError, err})
+		} else {
+			logEvent(d.Logger, LogInfo, "open", LogField{FieldDSN, fullDSN})
+		}
+	}()
+	defer protect(d.Logger, "Open", func(e error) { err = e })
+	db, opts, err := d.database(dsn, true)
+	if err != nil {
+		return nil, err
+	}
+	c := &SqliteJsConn{
+		JsDb: db.bdb.JS(),
 		mu:   &sync.Mutex{},
-	}, nil
+		db:   db,
+		dsn:  fullDSN,
+		log:  d.Logger,
+		tr:   d.Tracer,
+		slow: d.SlowPlans,
+	}
+	if opts.stmtCacheSize > 0 {
+		c.cache = newStmtCache(db, opts.stmtCacheSize, &c.stmts)
+	}
+	db.connsMu.Lock()
+	db.conns[c] = struct{}{}
+	db.connsMu.Unlock()
+	return c, nil
+}
+
+// database returns the database dsn names, which is opened if it isn't open yet and open is set,
+// or else nil, along with the connection options set by dsn.
+func (d *SqliteJsDriver) database(dsn string, open bool) (*database, options, error) {
+	name, opts, err := parseDSN(dsn)
+	if err != nil {
+		return nil, opts, err
+	}
+	backend := d.Backend
+	if backend == nil {
+		if backend, err = globalBackend(); err != nil {
+			return nil, opts, err
+		}
+	}
+	key := databaseKey{backend, name, opts.vfs}
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+	db := databases[key]
+	if db == nil && open {
+		// only the default backend shares the map, whose databases are all sql.js ones
+		var dbMap js.Value
+		if d.Backend == nil && opts.vfs == "" {
+			if m := js.Global().Get(globalSQLDBs); m.InstanceOf(js.Global().Get("Map")) {
+				dbMap = m
+			}
+		}
+		var bdb BackendDB
+		if dbMap.Truthy() {
+			if jsDB := dbMap.Call("get", name); jsDB.Truthy() {
+				bdb = adoptJSDB(backend, jsDB)
+			}
+		}
+		if bdb == nil {
+			if bdb, err = openBackendDB(backend, name, opts.vfs); err != nil {
+				return nil, opts, err
+			}
+		}
+		db = &database{bdb: bdb, conns: make(map[*SqliteJsConn]struct{})}
+		databases[key] = db
+		if dbMap.Truthy() {
+			dbMap.Call("set", name, bdb.JS())
+		}
+	}
+	return db, opts, nil
+}
+
+// openBackendDB opens the database called name with backend, using the VFS called vfs if set.
+func openBackendDB(backend Backend, name, vfs string) (BackendDB, error) {
+	if vfs == "" {
+		return backend.Open(name)
+	}
+	vb, ok := backend.(VFSBackend)
+	if !ok {
+		return nil, fmt.Errorf("open %q: the backend doesn't support choosing a VFS", name)
+	}
+	return vb.OpenVFS(name, vfs)
 }
 
 // Commit commits the transaction.
@@ -125,12 +275,123 @@ func (tx *SqliteJsTx) Rollback() error {
 // slice. If a particular column name isn't known, an empty
 // string should be returned for that entry.
 func (r *SqliteJsRows) Columns() []string {
-	res := r.s.js.Call("getColumnNames")
-	cols := make([]string, res.Length())
-	for i := 0; i < res.Length(); i++ {
-		cols[i] = res.Get(strconv.Itoa(i)).String()
+	if r.cols != nil {
+		return r.cols
+	}
+	cols, err := r.s.bs.ColumnNames()
+	if err != nil {
+		return []string{}
+	}
+	r.cols = cols
+	return r.cols
+}
+
+// columnType describes a result column.
+type columnType struct {
+	declType  string // as declared in the schema, e.g. "VARCHAR(255)", or empty for expressions
+	storage   string // storage class of the value in the first row, if read before the first Next
+	notNull   bool
+	notNullOK bool // whether notNull is known, i.e. the column comes straight from a table
+}
+
+// columnTypes returns the types of the result columns; must be called with locked mutex.
+func (r *SqliteJsRows) columnTypes() []columnType {
+	if r.types != nil {
+		return r.types
+	}
+	if t, ok := r.s.bs.(stmtColumnTyper); ok {
+		// the statement is only on the first row until Next is called, which may fetch rows
+		// ahead in a batch, so later rows have no storage class to report
+		firstRow := r.s.hasNext && r.trace.RowsScanned == 0 && r.s.batch.rows == 0
+		if types, err := t.columnTypes(firstRow); err == nil {
+			r.types = types
+			return r.types
+		}
+	}
+	// backends without the fast path only describe the number of columns
+	cols, _ := r.s.bs.ColumnNames()
+	r.types = make([]columnType, len(cols))
+	return r.types
+}
+
+// columnType returns the type of result column index, falling back to the storage class of
+// its value in the first row if it has no declared type.
+func (r *SqliteJsRows) columnType(index int) columnType {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.s.closed {
+		return columnType{}
 	}
-	return cols
+	types := r.columnTypes()
+	if index < 0 || index >= len(types) {
+		return columnType{}
+	}
+	col := types[index]
+	if col.declType == "" && col.storage != "NULL" {
+		col.declType = col.storage
+	}
+	return col
+}
+
+// ColumnTypeDatabaseTypeName returns the database system type name without the length,
+// in upper case, e.g. "VARCHAR" for a column declared as "varchar(255)". For columns without a
+// declared type, such as expressions, it returns the storage class of the value in the first row
+// if the column types are read before the first call to Next, and "" otherwise.
+func (r *SqliteJsRows) ColumnTypeDatabaseTypeName(index int) string {
+	declType := r.columnType(index).declType
+	if i := strings.IndexByte(declType, '('); i >= 0 {
+		declType = declType[:i]
+	}
+	return strings.ToUpper(strings.TrimSpace(declType))
+}
+
+// ColumnTypeScanType returns the value type that can be used to scan types into, following
+// SQLite's rules for determining the type affinity of a column from its declared type.
+func (r *SqliteJsRows) ColumnTypeScanType(index int) reflect.Type {
+	declType := strings.ToUpper(r.columnType(index).declType)
+	switch {
+	case declType == "":
+		return scanTypeAny
+	case strings.Contains(declType, "INT"):
+		return reflect.TypeOf(int64(0))
+	case strings.Contains(declType, "CHAR"), strings.Contains(declType, "CLOB"), strings.Contains(declType, "TEXT"):
+		return reflect.TypeOf("")
+	case strings.Contains(declType, "BLOB"):
+		return reflect.TypeOf([]byte(nil))
+	case strings.Contains(declType, "REAL"), strings.Contains(declType, "FLOA"), strings.Contains(declType, "DOUB"):
+		return reflect.TypeOf(float64(0))
+	}
+	// NUMERIC affinity, whose values may be either integers or reals
+	return scanTypeAny
+}
+
+var scanTypeAny = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// ColumnTypeNullable reports whether the column may be null. ok is false for columns which
+// don't come straight from a table, such as expressions.
+func (r *SqliteJsRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	col := r.columnType(index)
+	return !col.notNull, col.notNullOK
+}
+
+// ColumnTypeLength returns the column type length for variable length column types such
+// as text and binary field types: the length in the declared type, e.g. 255 for "VARCHAR(255)",
+// or math.MaxInt64 if there is none as SQLite doesn't enforce lengths.
+func (r *SqliteJsRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	declType := strings.ToUpper(r.columnType(index).declType)
+	if strings.Contains(declType, "INT") || !(strings.Contains(declType, "CHAR") ||
+		strings.Contains(declType, "CLOB") || strings.Contains(declType, "TEXT") || strings.Contains(declType, "BLOB")) {
+		return 0, false
+	}
+	if i := strings.IndexByte(declType, '('); i >= 0 {
+		end := strings.IndexAny(declType[i:], ",)")
+		if end > 0 {
+			if n, err := strconv.ParseInt(strings.TrimSpace(declType[i+1:i+end]), 10, 64); err == nil {
+				return n, true
+			}
+		}
+	}
+	return math.MaxInt64, true
 }
 
 // Next is called to populate the next row of data into
@@ -151,68 +412,68 @@ func (r *SqliteJsRows) Next(dest []driver.Value) error {
 	}
 
 	if r.ctx.Done() == nil {
-		return r.nextSyncLocked(dest)
+		return r.countRow(r.nextSyncLocked(dest))
 	}
 	resultCh := make(chan error)
 	go func() {
-		defer func() {
-			if perr := recover(); perr != nil {
-				fmt.Printf("SqliteJsRows.Next panicked! err=%s", perr)
-				resultCh <- fmt.Errorf("SqliteJsRows.Next panicked! err=%s", perr)
-			}
-		}()
+		defer protect(r.s.c.log, "SqliteJsRows.Next", func(e error) { resultCh <- e })
 		resultCh <- r.nextSyncLocked(dest)
 	}()
 	select {
 	case err := <-resultCh:
-		return err
+		return r.countRow(err)
 	case <-r.ctx.Done():
 		select {
 		case <-resultCh: // no need to interrupt
 		default:
-			// this is still racy and can be no-op if executed between sqlite3_* calls in nextSyncLocked.
-			// FIXME: find a way to interrupt
-			// C.sqlite3_interrupt(rc.s.c.db)
+			// only backends running SQLite off this thread can be interrupted, e.g. in a worker
+			stmtInterrupt(r.s.bs)
 			<-resultCh // ensure goroutine completed
 		}
-		return r.ctx.Err()
+		return r.countRow(r.ctx.Err())
 	}
 }
 
-// nextSyncLocked moves cursor to next; must be called with locked mutex.
-func (r *SqliteJsRows) nextSyncLocked(dest []driver.Value) error {
-	rr := r.s.Next()
-	if rr == nil {
-		return io.EOF
-	}
-	res := *rr
-	for i := 0; i < res.Length(); i++ {
-		jsVal := res.Get(strconv.Itoa(i))
-		switch t := jsVal.Type(); t {
-		case js.TypeNull:
-			dest[i] = nil
-		case js.TypeBoolean:
-			dest[i] = jsVal.Bool()
-		case js.TypeNumber:
-			dest[i] = jsVal.Int()
-		case js.TypeString:
-			dest[i] = jsVal.String()
-		case js.TypeSymbol:
-			log.Fatal("Don't know how to handle Symbols yet")
-		case js.TypeObject:
-			// check for []byte
-			if jsVal.Get("byteLength").Truthy() {
-				uint8slice := make([]uint8, jsVal.Get("byteLength").Int())
-				js.CopyBytesToGo(uint8slice, jsVal)
-				dest[i] = uint8slice
-			} else {
-				log.Fatal("Don't know how to handle Objects yet")
-			}
-		case js.TypeFunction:
-			log.Fatal("Don't know how to handle Functions yet")
+// countRow counts the row read by Next for the Tracer, or records the error it failed with.
+func (r *SqliteJsRows) countRow(err error) error {
+	switch err {
+	case nil:
+		r.trace.RowsScanned++
+	case io.EOF:
+	default:
+		if r.trace.Err == nil {
+			r.trace.Err = err
 		}
 	}
-	return nil
+	return err
+}
+
+// endResultSet records the current result set in the statement statistics and calls
+// Tracer.OnRowsClosed for it, once.
+func (r *SqliteJsRows) endResultSet() {
+	if r.ended {
+		return
+	}
+	r.ended = true
+	ev := r.trace
+	ev.Duration = time.Since(r.start)
+	var status stmtStatus
+	var statusOK bool
+	if !r.s.closed {
+		status, statusOK = r.s.c.readStatus(r.s.bs)
+	}
+	stmtStats.record(r.s.sql, ev, status)
+	if ev.Err == nil {
+		r.s.c.logSlowPlan(r.s.sql, r.bound, ev.Duration, status, statusOK)
+	}
+	if tr := r.s.c.tr; tr != nil {
+		tr.OnRowsClosed(r.traceCtx, ev)
+	}
+}
+
+// nextSyncLocked moves cursor to next; must be called with locked mutex.
+func (r *SqliteJsRows) nextSyncLocked(dest []driver.Value) error {
+	return r.s.nextLocked(dest)
 }
 
 // Close closes the rows iterator.
@@ -220,15 +481,72 @@ func (r *SqliteJsRows) Close() error {
 	r.s.mu.Lock()
 	defer r.s.mu.Unlock()
 
-	if r.s.closed || r.closed {
+	if r.closed {
 		return nil
 	}
 	r.closed = true
+	atomic.AddInt32(&r.s.c.rows, -1)
+	r.endResultSet()
+	if r.s.closed {
+		return nil
+	}
 	if r.cls {
-		return r.s.Close()
+		return r.s.closeLocked()
 	}
 
-	r.s.js.Call("reset")
+	r.s.batch = rowBatch{}
+	r.s.hasNext = false
+	return r.s.bs.Reset()
+}
+
+// HasNextResultSet is called at the end of the current result set and
+// reports whether there is another result set after the current one.
+func (r *SqliteJsRows) HasNextResultSet() bool {
+	return !r.closed && !isBlankSQL(r.tail)
+}
+
+// NextResultSet advances the driver to the next result set, which is the result of the
+// next statement in the query. Placeholders are bound from the args left over by the
+// previous statements.
+//
+// NextResultSet should return io.EOF when there are no more result sets.
+func (r *SqliteJsRows) NextResultSet() (err error) {
+	defer protect(r.s.c.log, "NextResultSet", func(e error) { err = e })
+	if r.closed || isBlankSQL(r.tail) {
+		return io.EOF
+	}
+	r.s.mu.Lock()
+	r.endResultSet()
+	err = r.s.closeLocked()
+	r.s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s, tail, err := r.s.c.nextStatement(r.ctx, r.tail)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		if len(r.args) != 0 {
+			return fmt.Errorf("too many args to query, query: %s nargs left=%d", r.tail, len(r.args))
+		}
+		return io.EOF
+	}
+	next, err := r.s.c.queryStatement(r.ctx, s, tail, r.args)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(&r.s.c.rows, -1) // next is merged into r, which stays open
+	r.s = next.s
+	r.tail = next.tail
+	r.args = next.args
+	r.bound = next.bound
+	r.trace = next.trace
+	r.traceCtx = next.traceCtx
+	r.start = next.start
+	r.ended = false
+	r.cols = nil
+	r.types = nil
 	return nil
 }
 
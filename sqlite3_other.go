@@ -0,0 +1,132 @@
+//go:build !(js && wasm)
+// +build !js !wasm
+
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupportedPlatform is returned when opening a database outside of js/wasm, where sql.js
+// isn't available, unless a native driver has been set with SetNativeDriver.
+var ErrUnsupportedPlatform = errors.New("sqlite3_js: sql.js is only available on js/wasm, use SetNativeDriver to open databases on this platform")
+
+var (
+	nativeMu     sync.RWMutex
+	nativeDriver driver.Driver
+)
+
+func init() {
+	sql.Register(DriverName, &SqliteJsDriver{})
+}
+
+// SetNativeDriver sets the driver which databases are opened with outside of js/wasm, e.g.
+// &sqlite3.SQLiteDriver{} from github.com/mattn/go-sqlite3, so that storage code shared with
+// the WASM build can be tested on the host.
+func SetNativeDriver(d driver.Driver) {
+	nativeMu.Lock()
+	defer nativeMu.Unlock()
+	nativeDriver = d
+}
+
+// SqliteJsDriver implements driver.Driver outside of js/wasm by delegating to the native
+// driver set with SetNativeDriver.
+type SqliteJsDriver struct {
+	ConnectHook func(*SqliteJsConn) error
+	// Logger receives the "open" events of the driver. If nil, the driver is silent.
+	Logger Logger
+	// Tracer is only called in js/wasm, as statements are run by the native driver here.
+	Tracer Tracer
+	// SlowPlans is only applied in js/wasm, for the same reason.
+	SlowPlans *SlowPlanOptions
+}
+
+// Open a database connection with the native driver. The DSN parameters only meaningful in
+// js/wasm, vfs and _stmt_cache_size, are removed, so that the same DSN opens on both; the
+// others are passed through untouched.
+func (d *SqliteJsDriver) Open(dsn string) (driver.Conn, error) {
+	nativeMu.RLock()
+	native := nativeDriver
+	nativeMu.RUnlock()
+	if native == nil {
+		logEvent(d.Logger, LogError, "open", LogField{FieldDSN, dsn}, LogField{FieldError, ErrUnsupportedPlatform})
+		return nil, ErrUnsupportedPlatform
+	}
+	conn, err := native.Open(nativeDSN(dsn))
+	if err != nil {
+		logEvent(d.Logger, LogError, "open", LogField{FieldDSN, dsn}, LogField{FieldError, err})
+		return nil, err
+	}
+	logEvent(d.Logger, LogInfo, "open", LogField{FieldDSN, dsn})
+	return conn, nil
+}
+
+// wasmParams are the DSN parameters only meaningful in js/wasm: the VFSes are those of the SQLite
+// WASM build, e.g. "opfs".
+var wasmParams = map[string]bool{"vfs": true, "_stmt_cache_size": true}
+
+// nativeDSN returns dsn without the parameters in wasmParams, keeping the others in order.
+func nativeDSN(dsn string) string {
+	i := strings.IndexByte(dsn, '?')
+	if i < 0 {
+		return dsn
+	}
+	var kept []string
+	for _, param := range strings.Split(dsn[i+1:], "&") {
+		key := param
+		if j := strings.IndexByte(param, '='); j >= 0 {
+			key = param[:j]
+		}
+		if !wasmParams[key] {
+			kept = append(kept, param)
+		}
+	}
+	if len(kept) == 0 {
+		return dsn[:i]
+	}
+	return dsn[:i+1] + strings.Join(kept, "&")
+}
+
+// SqliteJsConn is only ever returned by the driver in js/wasm. It is declared on other
+// platforms so that code shared with the WASM build compiles.
+type SqliteJsConn struct{}
+
+// BulkInsert returns ErrUnsupportedPlatform outside of js/wasm.
+func (conn *SqliteJsConn) BulkInsert(ctx context.Context, query string, rows [][]driver.Value) (driver.Result, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// Init does nothing outside of js/wasm, where there is no sql.js to load.
+func Init(ctx context.Context, cfg Config) error {
+	return nil
+}
+
+// DBStats returns ErrUnsupportedPlatform outside of js/wasm.
+func DBStats(dsn string) (*DatabaseStats, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// DBStats returns ErrUnsupportedPlatform outside of js/wasm.
+func (d *SqliteJsDriver) DBStats(dsn string) (*DatabaseStats, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// Backup returns ErrUnsupportedPlatform outside of js/wasm.
+func Backup(ctx context.Context, srcDSN, dstDSN string, pagesPerStep int, progress func(remaining, total int)) error {
+	return ErrUnsupportedPlatform
+}
+
+// Backup returns ErrUnsupportedPlatform outside of js/wasm.
+func (d *SqliteJsDriver) Backup(ctx context.Context, srcDSN, dstDSN string, pagesPerStep int, progress func(remaining, total int)) error {
+	return ErrUnsupportedPlatform
+}
+
+// snapshotConn returns ErrUnsupportedPlatform outside of js/wasm, where there is no export().
+func snapshotConn(conn *sql.Conn) (restore func() error, err error) {
+	return nil, ErrUnsupportedPlatform
+}
@@ -0,0 +1,56 @@
+//go:build !(js && wasm)
+// +build !js !wasm
+
+package sqlite3_js_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	sqlite3_js "github.com/matrix-org/go-sqlite3-js"
+)
+
+type fakeDriver struct {
+	dsns []string
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.dsns = append(d.dsns, dsn)
+	return nil, errors.New("fake driver")
+}
+
+func TestNativeDriver(t *testing.T) {
+	db, err := sql.Open(sqlite3_js.DriverName, "test.db?_stmt_cache_size=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); !errors.Is(err, sqlite3_js.ErrUnsupportedPlatform) {
+		t.Fatalf("expected ErrUnsupportedPlatform without a native driver, got %v", err)
+	}
+
+	native := &fakeDriver{}
+	sqlite3_js.SetNativeDriver(native)
+	defer sqlite3_js.SetNativeDriver(nil)
+	if err = db.Ping(); err == nil || err.Error() != "fake driver" {
+		t.Fatalf("expected error from the native driver, got %v", err)
+	}
+	if len(native.dsns) != 1 || native.dsns[0] != "test.db" {
+		t.Errorf("native driver opened %v, want [test.db]", native.dsns)
+	}
+
+	// the parameters only meaningful in js/wasm are removed, and the others kept
+	opfs, err := sql.Open(sqlite3_js.DriverName, "file:opfs.db?vfs=opfs&_busy_timeout=5000&_stmt_cache_size=0&mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opfs.Close()
+	if err = opfs.Ping(); err == nil || err.Error() != "fake driver" {
+		t.Fatalf("expected error from the native driver, got %v", err)
+	}
+	if want := "file:opfs.db?_busy_timeout=5000&mode=rwc"; len(native.dsns) != 2 || native.dsns[1] != want {
+		t.Errorf("native driver opened %v, want %s second", native.dsns, want)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build js && wasm
+// +build js,wasm
+
 // Copyright 2020 The Matrix.org Foundation C.I.C.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -18,10 +21,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"strings"
+	"syscall/js"
 	"testing"
+	"time"
 
-	_ "github.com/matrix-org/go-sqlite3-js"
+	sqlite3_js "github.com/matrix-org/go-sqlite3-js"
 )
 
 var i = 1
@@ -367,3 +375,1491 @@ func TestStarSelectMulti(t *testing.T) {
 		t.Errorf("Mismatched number of returned rows: %d != %d", len(wantIDs), i)
 	}
 }
+
+func TestConnQueryContext(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	ctx := context.Background()
+	wantIDs := []int{11, 12, 13}
+	wantNames := []string{"Eleven", "Mike", "Dustin"}
+	for i := range wantIDs {
+		_, err := db.ExecContext(ctx, "INSERT INTO foo VALUES(?,?)", wantIDs[i], wantNames[i])
+		if err != nil {
+			t.Fatalf("Insert failed: %s", err)
+		}
+	}
+
+	// run the same conn-level query repeatedly to check the statements are freed with the rows
+	for n := 0; n < 3; n++ {
+		rows, err := db.QueryContext(ctx, "SELECT name FROM foo WHERE id > ?", 11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gots []string
+		for rows.Next() {
+			var got string
+			if err := rows.Scan(&got); err != nil {
+				t.Fatalf("Scan failed: %s", err)
+			}
+			gots = append(gots, got)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatalf("Close failed: %s", err)
+		}
+		if len(gots) != 2 || gots[0] != "Mike" || gots[1] != "Dustin" {
+			t.Fatalf("Query %d: got %v, want [Mike Dustin]", n, gots)
+		}
+	}
+}
+
+func TestMultiStatementExec(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	res, err := db.Exec(
+		"INSERT INTO foo VALUES(?, 'semi;colon'); INSERT INTO foo VALUES(?, ?); UPDATE foo SET name = ? WHERE id = ?;",
+		1, 2, "two", "one", 1,
+	)
+	if err != nil {
+		t.Fatalf("multi-statement exec failed: %s", err)
+	}
+	if ra, _ := res.RowsAffected(); ra != 3 {
+		t.Errorf("expected 3 rows affected, got %d", ra)
+	}
+	if id, _ := res.LastInsertId(); id != 2 {
+		t.Errorf("expected last insert id 2, got %d", id)
+	}
+	assertStored(t, db, "SELECT name FROM foo ORDER BY id", []string{"one", "two"})
+
+	if _, err = db.Exec("INSERT INTO foo VALUES(?, 'x'); INSERT INTO foo VALUES(?, 'y')", 3); err == nil {
+		t.Errorf("expected error with too few args, got nil")
+	}
+	query := "INSERT INTO foo VALUES(?, 'x'); INSERT INTO foo VALUES(?, 'y')"
+	if _, err = db.Exec(query, 4, 5, 6); err == nil || !strings.Contains(err.Error(), query) {
+		t.Errorf("got error %v with too many args, want one quoting the query", err)
+	}
+}
+
+func TestMultipleResultSets(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	_, err := db.Exec("INSERT INTO foo VALUES(1, 'one'); INSERT INTO foo VALUES(2, 'two'); INSERT INTO foo VALUES(3, 'three')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryContext(context.Background(),
+		"SELECT name FROM foo WHERE id = ?; SELECT name FROM foo WHERE id > ? ORDER BY id;", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var sets [][]string
+	for {
+		var set []string
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				t.Fatalf("Scan failed: %s", err)
+			}
+			set = append(set, name)
+		}
+		sets = append(sets, set)
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sets) != "[[one] [two three]]" {
+		t.Errorf("got result sets %v, want [[one] [two three]]", sets)
+	}
+
+	// args left over once the last result set is reached are an error
+	rows, err = db.Query("SELECT name FROM foo WHERE id = ?; SELECT name FROM foo WHERE id > ?", 1, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatalf("expected a row in the first result set")
+	}
+	if rows.NextResultSet() || rows.Err() == nil {
+		t.Errorf("expected error for the last result set with too many args, got %v", rows.Err())
+	}
+	rows.Close()
+
+	// as they are with the statement cache disabled
+	uncached, err := sql.Open("sqlite3_js", fmt.Sprintf("test-%d.db?_stmt_cache_size=0", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = uncached.Query("SELECT name FROM foo WHERE id = ?", 1, 2); err == nil {
+		t.Errorf("expected error with too many args and no statement cache, got nil")
+	}
+}
+
+func TestColumnTypes(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name VARCHAR(255) NOT NULL, score REAL, data BLOB)")
+	if _, err := db.Exec("INSERT INTO foo VALUES(1, 'one', 1.5, x'00')"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT id, name, score, data, 1 + 1 FROM foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the declared types if the build reports them, and otherwise the storage classes of the
+	// first row, as for the expression
+	wantNames := []string{"INTEGER", "TEXT", "REAL", "BLOB", "INTEGER"}
+	wantScanTypes := []string{"int64", "string", "float64", "[]uint8", "int64"}
+	declared := cols[1].DatabaseTypeName() == "VARCHAR"
+	if declared {
+		wantNames[1] = "VARCHAR"
+	}
+	for i, col := range cols {
+		if got := col.DatabaseTypeName(); got != wantNames[i] {
+			t.Errorf("column %d: got type name %s, want %s", i, got, wantNames[i])
+		}
+		if got := col.ScanType().String(); got != wantScanTypes[i] {
+			t.Errorf("column %d: got scan type %s, want %s", i, got, wantScanTypes[i])
+		}
+	}
+	if length, ok := cols[1].Length(); declared && (!ok || length != 255) {
+		t.Errorf("name: got length %d (ok=%v), want 255", length, ok)
+	}
+	if _, ok := cols[0].Length(); ok {
+		t.Errorf("id: expected no length for INTEGER column")
+	}
+	if nullable, ok := cols[1].Nullable(); ok && nullable {
+		t.Errorf("name: expected NOT NULL column to not be nullable")
+	}
+
+	var score float64
+	for rows.Next() {
+		if err = rows.Scan(new(int), new(string), &score, new([]byte), new(int)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if score != 1.5 {
+		t.Errorf("score: got %v, want 1.5", score)
+	}
+
+	// once rows are read, the statement may be past the row they came from, so expressions
+	// have no type
+	rows, err = db.Query("SELECT x FROM (SELECT 1 AS x UNION ALL SELECT 'two')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatalf("expected a row")
+	}
+	if cols, err = rows.ColumnTypes(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cols[0].DatabaseTypeName(); got != "" {
+		t.Errorf("got type name %s for an expression after Next, want none", got)
+	}
+}
+
+func TestBatchedScan(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string, score REAL, data BLOB)")
+	// enough rows to span several batches
+	const numRows = 3000
+	if _, err := db.Exec(`WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM n WHERE x < ?)
+		INSERT INTO foo SELECT x, 'név ' || x, x + 0.5, CASE WHEN x % 2 = 0 THEN x'cafe' END FROM n`, numRows); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT id, name, score, data FROM foo ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+		var id int64
+		var name string
+		var score float64
+		var data []byte
+		if err = rows.Scan(&id, &name, &score, &data); err != nil {
+			t.Fatalf("Scan failed: %s", err)
+		}
+		if id != int64(n) || name != fmt.Sprintf("név %d", n) || score != float64(n)+0.5 {
+			t.Fatalf("Row %d: got (%d, %s, %v)", n, id, name, score)
+		}
+		if (n%2 == 0) != (len(data) == 2) {
+			t.Fatalf("Row %d: got data %x", n, data)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != numRows {
+		t.Errorf("got %d rows, want %d", n, numRows)
+	}
+}
+
+func TestLastInsertIdAndRowsAffected(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	for i := 1; i <= 3; i++ {
+		res, err := db.Exec("INSERT INTO foo(name) VALUES(?)", fmt.Sprintf("name %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, _ := res.LastInsertId(); id != int64(i) {
+			t.Errorf("insert %d: got last insert id %d", i, id)
+		}
+		if ra, _ := res.RowsAffected(); ra != 1 {
+			t.Errorf("insert %d: got %d rows affected, want 1", i, ra)
+		}
+	}
+	res, err := db.Exec("UPDATE foo SET name = 'x' WHERE id > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra, _ := res.RowsAffected(); ra != 2 {
+		t.Errorf("update: got %d rows affected, want 2", ra)
+	}
+}
+
+func TestStmtCache(t *testing.T) {
+	i++
+	db, err := sql.Open("sqlite3_js", fmt.Sprintf("test-%d.db?_stmt_cache_size=2", i))
+	if err != nil {
+		t.Fatalf("cannot open test.db: %s", err)
+	}
+	if _, err = db.Exec("create table foo(id INTEGER PRIMARY KEY, name string)"); err != nil {
+		t.Fatal(err)
+	}
+	// more distinct queries than the cache holds, each run several times
+	for n := 0; n < 3; n++ {
+		for id := 1; id <= 4; id++ {
+			_, err = db.Exec(fmt.Sprintf("INSERT OR REPLACE INTO foo VALUES(%d, ?)", id), fmt.Sprintf("name %d", n))
+			if err != nil {
+				t.Fatalf("Insert failed: %s", err)
+			}
+		}
+		assertStored(t, db, "SELECT name FROM foo WHERE id = 4", []string{fmt.Sprintf("name %d", n)})
+	}
+
+	// a schema change must not leave cached statements with the old columns
+	rows, err := db.Query("SELECT * FROM foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if _, err = db.Exec("ALTER TABLE foo ADD COLUMN extra string"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = db.Query("SELECT * FROM foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 3 {
+		t.Errorf("got columns %v after schema change, want 3 columns", cols)
+	}
+
+	// sql.js frees every statement on export(), including the cached ones, which must be
+	// prepared again rather than fail
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func() {
+		var name string
+		if err = conn.QueryRowContext(ctx, "SELECT name FROM foo WHERE id = ?", 4).Scan(&name); err != nil {
+			t.Fatalf("query failed: %s", err)
+		}
+		if _, err = conn.ExecContext(ctx, "UPDATE foo SET extra = ? WHERE id = 4", name); err != nil {
+			t.Fatalf("exec failed: %s", err)
+		}
+	}
+	query()
+	err = conn.Raw(func(driverConn interface{}) error {
+		driverConn.(*sqlite3_js.SqliteJsConn).JsDb.Call("export")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query()
+	conn.Close()
+
+	badDB, err := sql.Open("sqlite3_js", "test-x.db?_stmt_cache_size=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = badDB.Ping(); err == nil {
+		t.Errorf("expected error opening with a negative _stmt_cache_size, got nil")
+	}
+}
+
+func TestBulkInsert(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string, data BLOB)")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bulkInsert := func(rows [][]driver.Value) (res driver.Result, err error) {
+		err = conn.Raw(func(driverConn interface{}) error {
+			res, err = driverConn.(*sqlite3_js.SqliteJsConn).BulkInsert(ctx, "INSERT INTO foo VALUES(?, ?, ?)", rows)
+			return err
+		})
+		return res, err
+	}
+
+	var rows [][]driver.Value
+	for i := 1; i <= 1000; i++ {
+		rows = append(rows, []driver.Value{int64(i), fmt.Sprintf("name %d", i), []byte{byte(i)}})
+	}
+	res, err := bulkInsert(rows)
+	if err != nil {
+		t.Fatalf("BulkInsert failed: %s", err)
+	}
+	if ra, _ := res.RowsAffected(); ra != 1000 {
+		t.Errorf("got %d rows affected, want 1000", ra)
+	}
+	if id, _ := res.LastInsertId(); id != 1000 {
+		t.Errorf("got last insert id %d, want 1000", id)
+	}
+
+	// a failing row rolls back the whole batch
+	_, err = bulkInsert([][]driver.Value{{int64(1001), "ok", nil}, {int64(1), "conflict", nil}})
+	if err == nil {
+		t.Fatalf("expected error inserting a conflicting row, got nil")
+	}
+	assertStored(t, db, "SELECT COUNT(*) FROM foo", []string{"1000"})
+
+	// only the first statement would insert the rows
+	err = conn.Raw(func(driverConn interface{}) error {
+		_, err := driverConn.(*sqlite3_js.SqliteJsConn).BulkInsert(ctx,
+			"INSERT INTO foo VALUES(?, ?, ?); DELETE FROM foo", [][]driver.Value{{int64(1001), "one", nil}})
+		return err
+	})
+	if err == nil {
+		t.Fatalf("expected error bulk inserting with several statements, got nil")
+	}
+	assertStored(t, db, "SELECT COUNT(*) FROM foo", []string{"1000"})
+}
+
+func TestBackend(t *testing.T) {
+	sql.Register("sqlite3_js_backend", &sqlite3_js.SqliteJsDriver{
+		Backend: sqlite3_js.NewSQLJSBackend(js.Global().Get("_go_sqlite")),
+	})
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	other, err := sql.Open("sqlite3_js_backend", fmt.Sprintf("test-%d.db", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// databases with the same name are separate per backend
+	if _, err = other.Exec("SELECT * FROM foo"); err == nil {
+		t.Fatalf("expected error querying a table of another backend, got nil")
+	}
+	_, err = other.Exec(`
+		create table bar(id INTEGER PRIMARY KEY, name string); -- the schema
+		INSERT INTO bar VALUES(?, ?); /* and a row */
+	`, 1, "one")
+	if err != nil {
+		t.Fatalf("Exec failed: %s", err)
+	}
+	assertStored(t, other, "SELECT name FROM bar", []string{"one"})
+	if _, err = db.Exec("SELECT * FROM bar"); err == nil {
+		t.Fatalf("expected error querying a table of another backend, got nil")
+	}
+}
+
+// oo1StandInSource builds a stand-in for the oo1 API of the official SQLite WASM build on top of
+// a sql.js module, with an OpfsDb class keeping its databases in a Map as OPFS would. The opened
+// databases are listed in opened, and rows are passed through hooks.row if set.
+const oo1StandInSource = `
+var files = new Map();
+var opened = [];
+var hooks = {row: null};
+
+function Stmt(db, sql) {
+	this.s = db.sdb.prepare(sql);
+	this.pointer = this;
+	this.parameterCount = (sql.match(/\?/g) || []).length;
+}
+Stmt.prototype.bind = function(args) { this.s.bind(args); };
+Stmt.prototype.step = function() { return this.s.step(); };
+Stmt.prototype.get = function() {
+	var row = this.s.get().map(function(v) { return Number.isInteger(v) ? BigInt(v) : v; });
+	return hooks.row !== null ? hooks.row(row) : row;
+};
+Stmt.prototype.getColumnNames = function() { return this.s.getColumnNames(); };
+Stmt.prototype.reset = function() { this.s.reset(); };
+Stmt.prototype.finalize = function() { this.s.free(); };
+
+function DB(name, flags) {
+	this.sdb = new SQL.Database();
+	this.pointer = this;
+	opened.push({class: "DB", name: name});
+}
+DB.prototype.prepare = function(sql) { return new Stmt(this, sql); };
+DB.prototype.exec = function(sql) { this.sdb.exec(sql); };
+DB.prototype.selectArray = function(sql, params) {
+	var s = this.sdb.prepare(sql);
+	try {
+		s.bind(params);
+		return s.step() ? s.get() : undefined;
+	} finally {
+		s.free();
+	}
+};
+DB.prototype.close = function() {};
+
+function OpfsDb(name, flags) {
+	if (!files.has(name)) {
+		files.set(name, new SQL.Database());
+	}
+	this.sdb = files.get(name);
+	this.pointer = this;
+	opened.push({class: "OpfsDb", name: name});
+}
+OpfsDb.prototype = Object.create(DB.prototype);
+
+return {
+	oo1: {DB: DB, OpfsDb: OpfsDb},
+	capi: {
+		sqlite3_sql: function(stmt) { return stmt.s.getSQL(); },
+		sqlite3_changes: function(db) { return db.sdb.getRowsModified(); },
+		sqlite3_last_insert_rowid: function(db) { return BigInt(db.selectArray("SELECT last_insert_rowid()")[0]); },
+		sqlite3_js_db_export: function(db) { return db.sdb.export(); },
+		sqlite3_column_type: function() { return 0; },
+		sqlite3_vfs_find: function(name) { return name === "opfs" ? 1 : 0; },
+	},
+	opened: opened,
+	hooks: hooks,
+};
+`
+
+func TestOPFS(t *testing.T) {
+	standIn := js.Global().Get("Function").New("SQL", oo1StandInSource).Invoke(js.Global().Get("_go_sqlite"))
+	sql.Register("sqlite3_js_opfs", &sqlite3_js.SqliteJsDriver{
+		Backend: sqlite3_js.NewOO1Backend(standIn),
+	})
+	db, err := sql.Open("sqlite3_js_opfs", "file:opfs.db?vfs=opfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("create table foo(id INTEGER PRIMARY KEY, name string)"); err != nil {
+		t.Fatalf("cannot create schema: %s", err)
+	}
+	res, err := db.Exec("INSERT INTO foo VALUES(?, ?)", 3000000000, "big")
+	if err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	if id, _ := res.LastInsertId(); id != 3000000000 {
+		t.Errorf("got last insert id %d, want 3000000000", id)
+	}
+	var id int64
+	if err = db.QueryRow("SELECT id FROM foo").Scan(&id); err != nil {
+		t.Fatalf("QueryRow failed: %s", err)
+	}
+	if id != 3000000000 {
+		t.Errorf("got id %d, want 3000000000", id)
+	}
+	opened := standIn.Get("opened")
+	if opened.Length() != 1 || opened.Index(0).Get("class").String() != "OpfsDb" || opened.Index(0).Get("name").String() != "opfs.db" {
+		t.Errorf("expected opfs.db to be opened once with OpfsDb, got %s", js.Global().Get("JSON").Call("stringify", opened))
+	}
+
+	// the same name without vfs=opfs is a different database
+	plain, err := sql.Open("sqlite3_js_opfs", "opfs.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = plain.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if opened.Length() != 2 || opened.Index(1).Get("class").String() != "DB" {
+		t.Errorf("expected opfs.db to be opened again with DB, got %s", js.Global().Get("JSON").Call("stringify", opened))
+	}
+
+	// outside of a dedicated worker sqlite-wasm doesn't install the OPFS VFS
+	standIn.Get("oo1").Delete("OpfsDb")
+	other, err := sql.Open("sqlite3_js_opfs", "file:other.db?vfs=opfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Ping(); err == nil {
+		t.Errorf("expected error opening with vfs=opfs without OPFS, got nil")
+	}
+
+	// sql.js has no VFSes to choose from
+	sqljs, err := sql.Open("sqlite3_js", "file:opfs.db?vfs=opfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sqljs.Ping(); err == nil {
+		t.Errorf("expected error opening sql.js with vfs=opfs, got nil")
+	}
+}
+
+// workerStandInSource runs a worker script on this thread for a sql.js module, posting messages
+// between the worker and its scope asynchronously as structured clones, as a dedicated worker
+// would. worker.hold() holds back the replies of the worker until worker.release(), and
+// worker.fail(message) fires an error event on the worker.
+const workerStandInSource = `
+var worker = {listeners: {}};
+var scope = {listeners: {}, initSqlJs: function() { return Promise.resolve(SQL); }};
+var held = null;
+function listen(target) {
+	return function(type, fn) {
+		(target.listeners[type] = target.listeners[type] || []).push(fn);
+	};
+}
+function dispatch(target, type, e) {
+	(target.listeners[type] || []).forEach(function(fn) { fn(e); });
+}
+worker.addEventListener = listen(worker);
+scope.addEventListener = listen(scope);
+function post(to) {
+	return function(m) {
+		var data = structuredClone(m);
+		var deliver = function() {
+			setTimeout(function() { dispatch(to, "message", {data: data}); }, 0);
+		};
+		if (to === worker && held !== null) {
+			held.push(deliver);
+		} else {
+			deliver();
+		}
+	};
+}
+worker.postMessage = post(scope);
+scope.postMessage = post(worker);
+worker.hold = function() { held = []; };
+worker.release = function() {
+	var h = held;
+	held = null;
+	h.forEach(function(deliver) { deliver(); });
+};
+worker.fail = function(message) { dispatch(worker, "error", {message: message}); };
+function MessageChannel() {
+	var port1 = {};
+	this.port1 = port1;
+	this.port2 = {postMessage: function() { setTimeout(function() { port1.onmessage({}); }, 0); }};
+}
+new Function("self", "MessageChannel", script)(scope, MessageChannel);
+return worker;
+`
+
+func TestWorker(t *testing.T) {
+	worker := js.Global().Get("Function").New("SQL", "script", workerStandInSource).Invoke(
+		js.Global().Get("_go_sqlite"), sqlite3_js.WorkerScript(""))
+	sql.Register("sqlite3_js_worker", &sqlite3_js.SqliteJsDriver{
+		Backend: sqlite3_js.NewWorkerBackend(worker),
+	})
+	db, err := sql.Open("sqlite3_js_worker", "worker.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("create table foo(id INTEGER PRIMARY KEY, name string NOT NULL, data BLOB)"); err != nil {
+		t.Fatalf("cannot create schema: %s", err)
+	}
+	for i := 1; i <= 100; i++ {
+		res, err := db.Exec("INSERT INTO foo VALUES(?, ?, ?)", i, fmt.Sprintf("name %d", i), []byte{byte(i)})
+		if err != nil {
+			t.Fatalf("Insert failed: %s", err)
+		}
+		if id, _ := res.LastInsertId(); id != int64(i) {
+			t.Fatalf("got last insert id %d, want %d", id, i)
+		}
+	}
+	rows, err := db.Query("SELECT id, name, data FROM foo ORDER BY id")
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatalf("ColumnTypes failed: %s", err)
+	}
+	// TEXT is the storage class of the first row, for builds which don't report declared types
+	if got := types[1].DatabaseTypeName(); got != "STRING" && got != "TEXT" {
+		t.Errorf("got type %s for name, want STRING or TEXT", got)
+	}
+	n := 0
+	for rows.Next() {
+		var id int
+		var name string
+		var data []byte
+		if err = rows.Scan(&id, &name, &data); err != nil {
+			t.Fatalf("failed to scan row: %s", err)
+		}
+		n++
+		if id != n || name != fmt.Sprintf("name %d", n) || len(data) != 1 || data[0] != byte(n) {
+			t.Fatalf("got row (%d, %s, %v), want row %d", id, name, data, n)
+		}
+	}
+	rows.Close()
+	if n != 100 {
+		t.Errorf("got %d rows, want 100", n)
+	}
+
+	// errors thrown in the worker are returned
+	if _, err = db.Exec("INSERT INTO nope VALUES(1)"); err == nil {
+		t.Fatalf("expected error inserting into a missing table, got nil")
+	}
+	// VFSes are chosen in the worker, and sql.js has none
+	opfs, err := sql.Open("sqlite3_js_worker", "file:worker.db?vfs=opfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opfs.Ping(); err == nil || !strings.Contains(err.Error(), "openVFS") {
+		t.Errorf("got error %v opening sql.js in a worker with vfs=opfs, want one from openVFS", err)
+	}
+
+	// a failed migration restores the snapshot, which is opened as a new database in the worker
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	migrations := []sqlite3_js.Migration{
+		{Version: 1, SQL: "DELETE FROM foo"},
+		{Version: 2, SQL: "INSERT INTO nope VALUES(1)"},
+	}
+	version, err := sqlite3_js.Migrate(ctx, conn, migrations, &sqlite3_js.MigrateOptions{Snapshot: true})
+	if err == nil || version != 0 || !strings.Contains(err.Error(), "migration 2") {
+		t.Fatalf("got version %d, %v, want 0 and an error for migration 2", version, err)
+	}
+	var count int
+	if err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM foo").Scan(&count); err != nil || count != 100 {
+		t.Errorf("got %d rows, %v after restoring the snapshot, want 100", count, err)
+	}
+
+	// canceling an exec returns while the worker is still busy, and its late reply is dropped,
+	// without failing the calls of other connections to the database
+	other, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	stmt, err := conn.PrepareContext(ctx, "INSERT INTO foo VALUES(?, 'late', NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.Call("hold")
+	otherErr := make(chan error, 1)
+	go func() {
+		_, err := other.ExecContext(ctx, "INSERT INTO foo VALUES(102, 'other', NULL)")
+		otherErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	_, err = stmt.ExecContext(timeout, 101)
+	cancel()
+	worker.Call("release")
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v from an exec the worker didn't reply to, want %v", err, context.DeadlineExceeded)
+	}
+	if err = <-otherErr; err != nil {
+		t.Errorf("an exec on another connection failed with %v when one was canceled", err)
+	}
+	stmt.Close()
+	if err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM foo").Scan(&count); err != nil {
+		t.Errorf("cannot query after canceling an exec: %s", err)
+	}
+}
+
+func TestWorkerError(t *testing.T) {
+	worker := js.Global().Get("Function").New("SQL", "script", workerStandInSource).Invoke(
+		js.Global().Get("_go_sqlite"), sqlite3_js.WorkerScript(""))
+	sql.Register("sqlite3_js_worker_error", &sqlite3_js.SqliteJsDriver{
+		Backend: sqlite3_js.NewWorkerBackend(worker),
+	})
+	db, err := sql.Open("sqlite3_js_worker_error", "worker-error.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an error thrown by the worker script fails the calls waiting for a reply, and later ones
+	worker.Call("hold")
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Exec("CREATE TABLE foo(id INTEGER PRIMARY KEY)")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	worker.Call("fail", "boom")
+	if err = <-done; err == nil || !strings.Contains(err.Error(), "worker: boom") {
+		t.Errorf("got error %v from a call waiting for a failed worker, want worker: boom", err)
+	}
+	worker.Call("release")
+	if _, err = db.Exec("SELECT 1"); err == nil || !strings.Contains(err.Error(), "worker: boom") {
+		t.Errorf("got error %v from a call to a failed worker, want worker: boom", err)
+	}
+}
+
+func TestSeededDatabase(t *testing.T) {
+	dbMap := js.Global().Get("_go_sqlite_dbs")
+	if !dbMap.Truthy() {
+		dbMap = js.Global().Get("Map").New()
+		js.Global().Set("_go_sqlite_dbs", dbMap)
+	}
+	seeded := js.Global().Get("_go_sqlite").Get("Database").New()
+	seeded.Call("run", "CREATE TABLE foo(id INTEGER PRIMARY KEY, name TEXT); INSERT INTO foo VALUES(1, 'seeded')")
+	dbMap.Call("set", "seeded.db", seeded)
+	db, err := sql.Open("sqlite3_js", "seeded.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, db, "SELECT name FROM foo", []string{"seeded"})
+	if got := dbMap.Call("get", "seeded.db"); !got.Equal(seeded) {
+		t.Errorf("the seeded database was replaced in _go_sqlite_dbs")
+	}
+}
+
+func TestNewDriver(t *testing.T) {
+	sqlite3_js.Register("sqlite3_js_module", js.Global().Get("_go_sqlite"))
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	other, err := sql.Open("sqlite3_js_module", fmt.Sprintf("test-%d.db", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Exec("create table foo(id INTEGER PRIMARY KEY, name string)"); err != nil {
+		t.Fatalf("expected the database of a new driver to be empty, got %s", err)
+	}
+	if _, err = other.Exec("INSERT INTO foo VALUES(1, 'one')"); err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	assertStored(t, db, "SELECT COUNT(*) FROM foo", []string{"0"})
+
+	// a missing module fails to open rather than panicking
+	sql.Register("sqlite3_js_no_module", sqlite3_js.NewDriver(js.Undefined()))
+	broken, err := sql.Open("sqlite3_js_no_module", "broken.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = broken.Ping(); err == nil {
+		t.Errorf("expected error opening without a sql.js module, got nil")
+	}
+}
+
+func TestInit(t *testing.T) {
+	// earlier tests loaded sql.js through the _go_sqlite global, so hide it and start afresh
+	module := js.Global().Get("_go_sqlite")
+	js.Global().Set("_go_sqlite", js.Undefined())
+	old := sqlite3_js.SwapDefaultBackend(nil)
+	defer func() {
+		js.Global().Set("_go_sqlite", module)
+		sqlite3_js.SwapDefaultBackend(old)
+	}()
+
+	i++
+	before, err := sql.Open("sqlite3_js", fmt.Sprintf("test-%d.db", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = before.Ping(); err == nil || !strings.Contains(err.Error(), "call Init") {
+		t.Errorf("got error %v opening before Init, want one saying to call Init", err)
+	}
+	before.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = sqlite3_js.Init(ctx, sqlite3_js.Config{}); err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	// later calls do nothing
+	if err = sqlite3_js.Init(ctx, sqlite3_js.Config{WasmURL: "unused.wasm"}); err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	// with the global unset, the database can only be opened with the module Init loaded
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	assertStored(t, db, "SELECT COUNT(*) FROM foo", []string{"0"})
+}
+
+func TestDecoders(t *testing.T) {
+	standIn := js.Global().Get("Function").New("SQL", oo1StandInSource).Invoke(js.Global().Get("_go_sqlite"))
+	sql.Register("sqlite3_js_decoders", &sqlite3_js.SqliteJsDriver{
+		Backend: sqlite3_js.NewOO1Backend(standIn),
+	})
+	db, err := sql.Open("sqlite3_js_decoders", "decoders.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRow := func(src string) {
+		standIn.Get("hooks").Set("row", js.Global().Get("Function").New("row", src))
+	}
+
+	// values no decoder handles fail with a DecodeError
+	setRow("return [row[0], row[0] === 1n ? Symbol('x') : 'ok'];")
+	rows, err := db.Query("SELECT 1, 0 UNION ALL SELECT 2, 0")
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	if rows.Next() {
+		t.Fatalf("expected error decoding a Symbol, got a row")
+	}
+	var decodeErr *sqlite3_js.DecodeError
+	if !errors.As(rows.Err(), &decodeErr) || decodeErr.Column != 1 || decodeErr.Type != "symbol" {
+		t.Fatalf("got error %v, want a DecodeError for a symbol in column 1", rows.Err())
+	}
+	rows.Close()
+	var s string
+	setRow("return [new Date(86400000)];")
+	if err = db.QueryRow("SELECT 1").Scan(&s); !errors.As(err, &decodeErr) || decodeErr.Type != "Date" {
+		t.Fatalf("got error %v, want a DecodeError for a Date without a decoder", err)
+	}
+
+	sqlite3_js.RegisterDecoder(sqlite3_js.DecodeBigInt)
+	sqlite3_js.RegisterDecoder(sqlite3_js.DecodeDate)
+	sqlite3_js.RegisterDecoder(sqlite3_js.DecodeJSON)
+	setRow("return [new Date(86400000), {a: [1, 2]}, 2n ** 70n, 2n ** 40n, new Uint16Array([1])];")
+	var date time.Time
+	var obj []byte
+	var big string
+	var small int64
+	var data []byte
+	if err = db.QueryRow("SELECT 1, 2, 3, 4, 5").Scan(&date, &obj, &big, &small, &data); err != nil {
+		t.Fatalf("QueryRow failed: %s", err)
+	}
+	if !date.Equal(time.Unix(86400, 0)) {
+		t.Errorf("got date %s, want %s", date, time.Unix(86400, 0))
+	}
+	if string(obj) != `{"a":[1,2]}` {
+		t.Errorf("got object %s, want {\"a\":[1,2]}", obj)
+	}
+	if big != "1180591620717411303424" {
+		t.Errorf("got big %s, want 1180591620717411303424", big)
+	}
+	if small != 1<<40 {
+		t.Errorf("got small %d, want %d", small, int64(1<<40))
+	}
+	if len(data) != 2 || data[0] != 1 || data[1] != 0 {
+		t.Errorf("got data %v, want [1 0]", data)
+	}
+}
+
+type logEvent struct {
+	level  sqlite3_js.LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+type testLogger struct {
+	events []logEvent
+}
+
+func (l *testLogger) Log(level sqlite3_js.LogLevel, msg string, fields ...sqlite3_js.LogField) {
+	e := logEvent{level, msg, make(map[string]interface{})}
+	for _, f := range fields {
+		e.fields[f.Key] = f.Value
+	}
+	l.events = append(l.events, e)
+}
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	sql.Register("sqlite3_js_logger", &sqlite3_js.SqliteJsDriver{Logger: logger})
+	db, err := sql.Open("sqlite3_js_logger", "logger.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec("create table foo(id INTEGER PRIMARY KEY, name string)"); err != nil {
+		t.Fatalf("cannot create schema: %s", err)
+	}
+	if _, err = db.Exec("INSERT INTO nope VALUES(1)"); err == nil {
+		t.Fatalf("expected error inserting into a missing table, got nil")
+	}
+	if len(logger.events) != 3 {
+		t.Fatalf("got %d log events, want 3: %v", len(logger.events), logger.events)
+	}
+	open, exec, failed := logger.events[0], logger.events[1], logger.events[2]
+	if open.level != sqlite3_js.LogInfo || open.msg != "open" || open.fields[sqlite3_js.FieldDSN] != "logger.db" {
+		t.Errorf("got open event %v", open)
+	}
+	if exec.level != sqlite3_js.LogDebug || exec.msg != "exec" ||
+		exec.fields[sqlite3_js.FieldSQL] != "create table foo(id INTEGER PRIMARY KEY, name string)" {
+		t.Errorf("got exec event %v", exec)
+	}
+	if _, ok := exec.fields[sqlite3_js.FieldDuration].(time.Duration); !ok {
+		t.Errorf("exec event has no duration: %v", exec)
+	}
+	if failed.level != sqlite3_js.LogWarn || failed.fields[sqlite3_js.FieldError] == nil {
+		t.Errorf("got failed exec event %v", failed)
+	}
+}
+
+type traceKey struct{}
+
+type testTracer struct {
+	events   []string
+	prepared []sqlite3_js.TraceEvent
+	closed   []sqlite3_js.TraceEvent
+	ended    []sqlite3_js.TraceEvent
+}
+
+func (tr *testTracer) OnPrepare(ctx context.Context, ev sqlite3_js.TraceEvent) {
+	tr.events = append(tr.events, "prepare "+ev.SQL)
+	tr.prepared = append(tr.prepared, ev)
+}
+
+func (tr *testTracer) OnExecStart(ctx context.Context, ev sqlite3_js.TraceEvent) context.Context {
+	tr.events = append(tr.events, "exec "+ev.SQL)
+	return context.WithValue(ctx, traceKey{}, "exec span")
+}
+
+func (tr *testTracer) OnExecEnd(ctx context.Context, ev sqlite3_js.TraceEvent) {
+	tr.events = append(tr.events, fmt.Sprintf("exec end %v", ctx.Value(traceKey{})))
+	tr.ended = append(tr.ended, ev)
+}
+
+func (tr *testTracer) OnQueryStart(ctx context.Context, ev sqlite3_js.TraceEvent) context.Context {
+	tr.events = append(tr.events, "query "+ev.SQL)
+	return context.WithValue(ctx, traceKey{}, "query span")
+}
+
+func (tr *testTracer) OnRowsClosed(ctx context.Context, ev sqlite3_js.TraceEvent) {
+	tr.events = append(tr.events, fmt.Sprintf("rows closed %v", ctx.Value(traceKey{})))
+	tr.closed = append(tr.closed, ev)
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	sql.Register("sqlite3_js_tracer", &sqlite3_js.SqliteJsDriver{Tracer: tracer})
+	db, err := sql.Open("sqlite3_js_tracer", "tracer.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec("create table foo(id INTEGER PRIMARY KEY, name string)"); err != nil {
+		t.Fatalf("cannot create schema: %s", err)
+	}
+	stmt, err := db.Prepare("INSERT INTO foo VALUES(?, ?)")
+	if err != nil {
+		t.Fatalf("Prepare failed: %s", err)
+	}
+	for id := 1; id <= 3; id++ {
+		if _, err = stmt.Exec(id, "x"); err != nil {
+			t.Fatalf("Insert failed: %s", err)
+		}
+	}
+	stmt.Close()
+	rows, err := db.Query("SELECT id FROM foo WHERE id > ?", 0)
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if _, err = db.Query("SELECT nope FROM foo"); err == nil {
+		t.Fatalf("expected error querying a missing column, got nil")
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Raw(func(driverConn interface{}) error {
+		_, err := driverConn.(*sqlite3_js.SqliteJsConn).BulkInsert(context.Background(), "INSERT INTO foo VALUES(?, ?)",
+			[][]driver.Value{{int64(4), "y"}, {int64(5), "y"}})
+		return err
+	})
+	conn.Close()
+	if err != nil {
+		t.Fatalf("BulkInsert failed: %s", err)
+	}
+
+	wants := []string{
+		"prepare create table foo(id INTEGER PRIMARY KEY, name string)",
+		"exec create table foo(id INTEGER PRIMARY KEY, name string)", "exec end exec span",
+		"prepare INSERT INTO foo VALUES(?, ?)",
+		"exec INSERT INTO foo VALUES(?, ?)", "exec end exec span",
+		"exec INSERT INTO foo VALUES(?, ?)", "exec end exec span",
+		"exec INSERT INTO foo VALUES(?, ?)", "exec end exec span",
+		"prepare SELECT id FROM foo WHERE id > ?",
+		"query SELECT id FROM foo WHERE id > ?", "rows closed query span",
+		// prepare errors are reported too
+		"prepare SELECT nope FROM foo",
+		"prepare INSERT INTO foo VALUES(?, ?)",
+		"exec INSERT INTO foo VALUES(?, ?)", "exec end exec span",
+	}
+	if len(tracer.events) != len(wants) {
+		t.Fatalf("got trace events %q, want %q", tracer.events, wants)
+	}
+	for i := range wants {
+		if tracer.events[i] != wants[i] {
+			t.Errorf("trace event %d: got %q, want %q", i, tracer.events[i], wants[i])
+		}
+	}
+	if ev := tracer.ended[1]; ev.Args != 2 || ev.RowsAffected != 1 || ev.Err != nil {
+		t.Errorf("got exec end event %+v, want 2 args and 1 row affected", ev)
+	}
+	if ev := tracer.closed[0]; ev.Args != 1 || ev.RowsScanned != 3 || ev.Err != nil {
+		t.Errorf("got rows closed event %+v, want 1 arg and 3 rows scanned", ev)
+	}
+	if len(tracer.prepared) != 5 || tracer.prepared[3].Err == nil {
+		t.Errorf("got prepare events %+v, want the fourth to fail", tracer.prepared)
+	}
+	if ev := tracer.ended[4]; ev.Args != 4 || ev.RowsAffected != 2 || ev.Err != nil {
+		t.Errorf("got bulk insert end event %+v, want 4 args and 2 rows affected", ev)
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	sqlite3_js.ResetStats()
+	for id := 1; id <= 3; id++ {
+		if _, err := db.Exec(fmt.Sprintf("INSERT INTO foo VALUES(%d,  'name %d')", id, id)); err != nil {
+			t.Fatalf("Insert failed: %s", err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO foo VALUES(1, 'dup')"); err == nil {
+		t.Fatalf("expected error inserting a duplicate, got nil")
+	}
+	assertStored(t, db, "SELECT name FROM foo WHERE id > 1 -- names", []string{"name 2", "name 3"})
+
+	stats := make(map[string]sqlite3_js.StatementStats)
+	for _, st := range sqlite3_js.Stats() {
+		stats[st.SQL] = st
+	}
+	insert, ok := stats["INSERT INTO foo VALUES(?, ?)"]
+	if !ok {
+		t.Fatalf("no stats for the inserts, got %+v", stats)
+	}
+	if insert.Calls != 4 || insert.RowsChanged != 3 || insert.Errors != 1 || insert.MaxTime > insert.TotalTime {
+		t.Errorf("got insert stats %+v, want 4 calls, 3 rows changed and 1 error", insert)
+	}
+	if sel := stats["SELECT name FROM foo WHERE id > ?"]; sel.Calls != 1 || sel.RowsReturned != 2 {
+		t.Errorf("got select stats %+v, want 1 call returning 2 rows", sel)
+	}
+
+	// texts with inlined literals beyond the number tracked are still aggregated
+	sqlite3_js.ResetStats()
+	for n := 0; n < 1100; n++ {
+		assertStored(t, db, fmt.Sprintf("SELECT %d", n), []string{fmt.Sprint(n)})
+	}
+	if stats := sqlite3_js.Stats(); len(stats) != 1 || stats[0].SQL != "SELECT ?" || stats[0].Calls != 1100 {
+		t.Errorf("got stats %+v, want 1100 calls of SELECT ?", stats)
+	}
+
+	sqlite3_js.ResetStats()
+	if stats := sqlite3_js.Stats(); len(stats) != 0 {
+		t.Errorf("got stats %+v after reset, want none", stats)
+	}
+	sqlite3_js.SetStatsEnabled(false)
+	defer sqlite3_js.SetStatsEnabled(true)
+	assertStored(t, db, "SELECT name FROM foo WHERE id = 1", []string{"name 1"})
+	if stats := sqlite3_js.Stats(); len(stats) != 0 {
+		t.Errorf("got stats %+v while disabled, want none", stats)
+	}
+}
+
+func TestDBStats(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string)")
+	dsn := fmt.Sprintf("test-%d.db", i)
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("INSERT INTO foo VALUES(1, 'one')"); err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	rows, err := db.Query("SELECT id FROM foo")
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	stats, err := sqlite3_js.DBStats(dsn)
+	if err != nil {
+		t.Fatalf("DBStats failed: %s", err)
+	}
+	if stats.PageCount < 2 || stats.PageSize == 0 || stats.ImageSize != stats.PageCount*stats.PageSize {
+		t.Errorf("got %d pages of %d bytes, image size %d", stats.PageCount, stats.PageSize, stats.ImageSize)
+	}
+	if stats.HeapSize == 0 {
+		t.Errorf("got heap size 0, want it known or -1")
+	}
+	if len(stats.Conns) != 1 || stats.Conns[0].Rows != 1 || stats.Conns[0].Stmts < 1 {
+		t.Errorf("got connections %+v, want 1 with open rows", stats.Conns)
+	}
+	rows.Close()
+	if stats, err = sqlite3_js.DBStats(dsn); err != nil {
+		t.Fatalf("DBStats failed: %s", err)
+	}
+	if len(stats.Conns) != 1 || stats.Conns[0].Rows != 0 {
+		t.Errorf("got connections %+v after closing rows, want none open", stats.Conns)
+	}
+	// the closed statements stay prepared in the statement cache
+	if len(stats.Conns) == 1 && stats.Conns[0].Stmts < 1 {
+		t.Errorf("got %d statements after closing rows, want the cached ones counted", stats.Conns[0].Stmts)
+	}
+
+	if _, err = sqlite3_js.DBStats("missing.db"); err == nil {
+		t.Errorf("expected error for a database which isn't open, got nil")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := newDB(t, `create table foo(id INTEGER PRIMARY KEY AUTOINCREMENT, name string);
+		create index foo_name on foo(name);
+		create view foo_names as select name from foo;
+		PRAGMA user_version = 7`)
+	srcDSN := fmt.Sprintf("test-%d.db", i)
+	for id := 1; id <= 300; id++ {
+		if _, err := db.Exec("INSERT INTO foo(name) VALUES(?)", fmt.Sprintf("name %d", id)); err != nil {
+			t.Fatalf("Insert failed: %s", err)
+		}
+	}
+	dstDSN := fmt.Sprintf("backup-%d.db", i)
+	dst, err := sql.Open("sqlite3_js", dstDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dst.Exec("create table old(id INTEGER)"); err != nil {
+		t.Fatalf("cannot create schema: %s", err)
+	}
+
+	var calls, remaining int
+	err = sqlite3_js.Backup(context.Background(), srcDSN, dstDSN, 1, func(r, total int) {
+		calls++
+		remaining = r
+	})
+	if err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	if calls == 0 || remaining != 0 {
+		t.Errorf("got %d progress calls ending with %d pages remaining", calls, remaining)
+	}
+	assertStored(t, dst, "SELECT COUNT(*) FROM foo_names", []string{"300"})
+	assertStored(t, dst, "SELECT name FROM foo WHERE id = 300", []string{"name 300"})
+	assertStored(t, dst, "SELECT COUNT(*) FROM sqlite_master WHERE name IN ('old', 'foo_name')", []string{"1"})
+	assertStored(t, dst, "PRAGMA user_version", []string{"7"})
+	// AUTOINCREMENT carries on where the source left off
+	if _, err = db.Exec("DELETE FROM foo WHERE id = 300"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if _, err = dst.Exec("DELETE FROM foo WHERE id = 300; INSERT INTO foo(name) VALUES('next')"); err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	assertStored(t, dst, "SELECT id FROM foo WHERE name = 'next'", []string{"301"})
+
+	// restore the source from the backup
+	if err = sqlite3_js.Backup(context.Background(), dstDSN, srcDSN, 0, nil); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	assertStored(t, db, "SELECT COUNT(*) FROM foo", []string{"300"})
+
+	if err = sqlite3_js.Backup(context.Background(), "missing.db", dstDSN, 0, nil); err == nil {
+		t.Errorf("expected error backing up a database which isn't open, got nil")
+	}
+	if err = sqlite3_js.Backup(context.Background(), srcDSN, srcDSN, 0, nil); err == nil {
+		t.Errorf("expected error backing up a database into itself, got nil")
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	db := newDB(t, `create table foo(id INTEGER PRIMARY KEY AUTOINCREMENT, name string, score real, data blob);
+		create index foo_name on foo(name);
+		create view foo_names as select name from foo;
+		create trigger foo_bump after insert on foo begin update foo set score = score + 1 where id = new.id; end`)
+	// sql.js binds integral numbers as integers, so the REAL 2.0 is inlined
+	if _, err := db.Exec("INSERT INTO foo(name, score, data) VALUES(?, ?, ?), (?, ?, 2.0)",
+		"it's\nmultiline", 1.0, []byte{0, 0xff}, nil, 2.5); err != nil {
+		t.Fatalf("Insert failed: %s", err)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var dump strings.Builder
+	if err = sqlite3_js.Dump(ctx, conn, &dump); err != nil {
+		t.Fatalf("Dump failed: %s", err)
+	}
+	for _, want := range []string{
+		"BEGIN TRANSACTION;\n",
+		`INSERT INTO "foo" VALUES(1,'it''s'||char(10)||'multiline',2.0,X'00FF');` + "\n",
+		// a REAL in a column without REAL affinity stays a REAL
+		`INSERT INTO "foo" VALUES(2,NULL,3.5,2.0);` + "\n",
+		"DELETE FROM sqlite_sequence;\n",
+		"create trigger foo_bump after insert on foo begin update foo set score = score + 1 where id = new.id; end;\n",
+		"COMMIT;\n",
+	} {
+		if !strings.Contains(dump.String(), want) {
+			t.Errorf("dump is missing %q, got:\n%s", want, dump.String())
+		}
+	}
+
+	restored := newDB(t, "select 1")
+	rconn, err := restored.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+	if err = sqlite3_js.Restore(ctx, rconn, strings.NewReader(dump.String())); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	// the trigger is created after the rows, so it doesn't bump them again
+	assertStored(t, restored, "SELECT score FROM foo ORDER BY id", []string{"2", "3.5"})
+	assertStored(t, restored, "SELECT typeof(data) FROM foo ORDER BY id", []string{"blob", "real"})
+	assertStored(t, restored, "SELECT name FROM foo_names WHERE name IS NOT NULL", []string{"it's\nmultiline"})
+	assertStored(t, restored, "SELECT seq FROM sqlite_sequence WHERE name = 'foo'", []string{"2"})
+
+	if err = sqlite3_js.Restore(ctx, rconn, strings.NewReader("BEGIN;\nINSERT INTO nope VALUES(1);\n")); err == nil ||
+		!strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got error %v restoring into a missing table, want one for line 2", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	db := newDB(t, "create table foo(id INTEGER PRIMARY KEY, name string, data blob)")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	csvIn := "ID,full_name\n1,\"one, uno\"\n2,\n"
+	n, err := sqlite3_js.ImportTable(ctx, conn, "foo", sqlite3_js.CSV, strings.NewReader(csvIn),
+		&sqlite3_js.ImportOptions{Columns: map[string]string{"full_name": "name"}})
+	if err != nil || n != 2 {
+		t.Fatalf("ImportTable got %d rows, %v, want 2", n, err)
+	}
+	jsonIn := `{"id": 3, "name": "three", "extra": {"a": 1}}` + "\n\n" + `{"name": "four", "id": 4}`
+	n, err = sqlite3_js.ImportTable(ctx, conn, "foo", sqlite3_js.NDJSON, strings.NewReader(jsonIn),
+		&sqlite3_js.ImportOptions{Columns: map[string]string{"extra": "data"}})
+	if err != nil || n != 2 {
+		t.Fatalf("ImportTable got %d rows, %v, want 2", n, err)
+	}
+	assertStored(t, db, "SELECT IFNULL(name, 'null') || '/' || IFNULL(data, 'null') FROM foo ORDER BY id",
+		[]string{"one, uno/null", "null/null", `three/{"a":1}`, "four/null"})
+
+	// a failing row leaves the table untouched
+	if _, err = sqlite3_js.ImportTable(ctx, conn, "foo", sqlite3_js.NDJSON,
+		strings.NewReader(`{"id": 5}`+"\n"+`{"id": 1}`), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got error %v importing a duplicate, want one for line 2", err)
+	}
+	if _, err = sqlite3_js.ImportTable(ctx, conn, "foo", sqlite3_js.NDJSON, strings.NewReader(`{"nope": 1}`), nil); err == nil {
+		t.Errorf("expected error importing a field without a column, got nil")
+	}
+	assertStored(t, db, "SELECT COUNT(*) FROM foo", []string{"4"})
+
+	var out strings.Builder
+	if err = sqlite3_js.ExportQuery(ctx, conn, "SELECT id, name FROM foo WHERE id < ? ORDER BY id", sqlite3_js.CSV, &out, 3); err != nil {
+		t.Fatalf("ExportQuery failed: %s", err)
+	}
+	if want := "id,name\n1,\"one, uno\"\n2,\n"; out.String() != want {
+		t.Errorf("got CSV %q, want %q", out.String(), want)
+	}
+	out.Reset()
+	if err = sqlite3_js.ExportQuery(ctx, conn, "SELECT id, name, X'0102' AS data FROM foo WHERE id IN (2, 3) ORDER BY id", sqlite3_js.NDJSON, &out); err != nil {
+		t.Fatalf("ExportQuery failed: %s", err)
+	}
+	if want := `{"id":2,"name":null,"data":"AQI="}` + "\n" + `{"id":3,"name":"three","data":"AQI="}` + "\n"; out.String() != want {
+		t.Errorf("got NDJSON %q, want %q", out.String(), want)
+	}
+
+	// fields mapped to "" are skipped, and blobs exported in base64 are imported as blobs
+	n, err = sqlite3_js.ImportTable(ctx, conn, "foo", sqlite3_js.CSV, strings.NewReader("id,skipped,data\n5,x,AQI=\n"),
+		&sqlite3_js.ImportOptions{Columns: map[string]string{"skipped": ""}})
+	if err != nil || n != 1 {
+		t.Fatalf("ImportTable got %d rows, %v, want 1", n, err)
+	}
+	n, err = sqlite3_js.ImportTable(ctx, conn, "foo", sqlite3_js.NDJSON, strings.NewReader(`{"id": 6, "data": "AQI="}`), nil)
+	if err != nil || n != 1 {
+		t.Fatalf("ImportTable got %d rows, %v, want 1", n, err)
+	}
+	assertStored(t, db, "SELECT typeof(data) || ' ' || hex(data) FROM foo WHERE id > 4 ORDER BY id", []string{"blob 0102", "blob 0102"})
+}
+
+func TestMigrate(t *testing.T) {
+	db := newDB(t, "select 1")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	migrations := []sqlite3_js.Migration{
+		{Version: 2, Name: "add names", SQL: "ALTER TABLE foo ADD COLUMN name string"},
+		{Version: 1, Name: "create foo", SQL: "CREATE TABLE foo(id INTEGER PRIMARY KEY); INSERT INTO foo VALUES(1)"},
+		{Version: 3, Func: func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, "UPDATE foo SET name = 'one'")
+			return err
+		}},
+	}
+
+	version, err := sqlite3_js.Migrate(ctx, conn, migrations, &sqlite3_js.MigrateOptions{DryRun: true})
+	if err != nil || version != 3 {
+		t.Fatalf("dry run got version %d, %v, want 3", version, err)
+	}
+	assertStored(t, db, "SELECT COUNT(*) FROM sqlite_master WHERE name = 'foo'", []string{"0"})
+
+	if version, err = sqlite3_js.Migrate(ctx, conn, migrations, &sqlite3_js.MigrateOptions{Target: 2}); err != nil || version != 2 {
+		t.Fatalf("got version %d, %v, want 2", version, err)
+	}
+	assertStored(t, db, "PRAGMA user_version", []string{"2"})
+	assertStored(t, db, "SELECT COUNT(*) FROM foo WHERE name IS NULL", []string{"1"})
+
+	// a failing step restores the snapshot taken before the first pending step
+	failing := append(migrations, sqlite3_js.Migration{Version: 4, SQL: "INSERT INTO nope VALUES(1)"})
+	version, err = sqlite3_js.Migrate(ctx, conn, failing, &sqlite3_js.MigrateOptions{Snapshot: true})
+	if err == nil || version != 2 || !strings.Contains(err.Error(), "migration 4") {
+		t.Fatalf("got version %d, %v, want 2 and an error for migration 4", version, err)
+	}
+	assertStored(t, db, "PRAGMA user_version", []string{"2"})
+	assertStored(t, db, "SELECT COUNT(*) FROM foo WHERE name IS NULL", []string{"1"})
+
+	// the snapshot is restored even if a step failed because its context was canceled
+	canceled, cancel := context.WithCancel(ctx)
+	timedOut := append(migrations, sqlite3_js.Migration{Version: 4, Func: func(ctx context.Context, conn *sql.Conn) error {
+		cancel()
+		return ctx.Err()
+	}})
+	version, err = sqlite3_js.Migrate(canceled, conn, timedOut, &sqlite3_js.MigrateOptions{Snapshot: true})
+	if err == nil || version != 2 || !strings.Contains(err.Error(), "migration 4") {
+		t.Fatalf("got version %d, %v, want 2 and an error for migration 4", version, err)
+	}
+	assertStored(t, db, "PRAGMA user_version", []string{"2"})
+	assertStored(t, db, "SELECT COUNT(*) FROM foo WHERE name IS NULL", []string{"1"})
+
+	if version, err = sqlite3_js.Migrate(ctx, conn, migrations, nil); err != nil || version != 3 {
+		t.Fatalf("got version %d, %v, want 3", version, err)
+	}
+	assertStored(t, db, "SELECT name FROM foo", []string{"one"})
+	if _, err = sqlite3_js.Migrate(ctx, conn, migrations, &sqlite3_js.MigrateOptions{Target: 1}); err == nil {
+		t.Errorf("expected error migrating down, got nil")
+	}
+}
+
+func TestReadSchema(t *testing.T) {
+	db := newDB(t, `CREATE TABLE parent(a INTEGER, b TEXT NOT NULL DEFAULT 'x', PRIMARY KEY(b, a));
+		CREATE TABLE child(id INTEGER PRIMARY KEY, pa INTEGER, pb TEXT UNIQUE,
+			FOREIGN KEY(pa, pb) REFERENCES parent(a, b) ON DELETE CASCADE);
+		CREATE INDEX child_pa ON child(pa) WHERE pa > 0;
+		CREATE VIEW kids AS SELECT id, pb FROM child;
+		CREATE TRIGGER child_ai AFTER INSERT ON child BEGIN SELECT 1; END;`)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := sqlite3_js.ReadSchema(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tables) != 2 || s.Tables[0].Name != "child" || s.Tables[1].Name != "parent" {
+		t.Fatalf("got tables %+v, want child and parent", s.Tables)
+	}
+	if len(s.Views) != 1 || s.Views[0].Name != "kids" || len(s.Views[0].Columns) != 2 {
+		t.Errorf("got views %+v, want kids with 2 columns", s.Views)
+	}
+	if len(s.Triggers) != 1 || s.Triggers[0].Name != "child_ai" || s.Triggers[0].Table != "child" {
+		t.Errorf("got triggers %+v, want child_ai on child", s.Triggers)
+	}
+
+	parent := s.Tables[1]
+	if len(parent.Columns) != 2 {
+		t.Fatalf("got columns %+v, want 2", parent.Columns)
+	}
+	b := parent.Columns[1]
+	if b.Name != "b" || b.Type != "TEXT" || !b.NotNull || b.Default == nil || *b.Default != "'x'" || b.PrimaryKey != 1 {
+		t.Errorf("got column %+v, want b TEXT NOT NULL DEFAULT 'x' first in the primary key", b)
+	}
+	if a := parent.Columns[0]; a.NotNull || a.Default != nil || a.PrimaryKey != 2 {
+		t.Errorf("got column %+v, want a second in the primary key", a)
+	}
+
+	child, err := sqlite3_js.ReadTable(ctx, conn, "child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(child.Indexes) != 2 {
+		t.Fatalf("got indexes %+v, want 2", child.Indexes)
+	}
+	if idx := child.Indexes[0]; idx.Name != "child_pa" || idx.Unique || idx.Origin != "c" || !idx.Partial ||
+		len(idx.Columns) != 1 || idx.Columns[0] != "pa" || idx.SQL == "" {
+		t.Errorf("got index %+v, want partial child_pa on pa", idx)
+	}
+	if idx := child.Indexes[1]; !idx.Unique || idx.Origin != "u" || len(idx.Columns) != 1 || idx.Columns[0] != "pb" {
+		t.Errorf("got index %+v, want unique index on pb", idx)
+	}
+	if len(child.ForeignKeys) != 1 {
+		t.Fatalf("got foreign keys %+v, want 1", child.ForeignKeys)
+	}
+	fk := child.ForeignKeys[0]
+	if fk.Table != "parent" || strings.Join(fk.From, ",") != "pa,pb" || strings.Join(fk.To, ",") != "a,b" || fk.OnDelete != "CASCADE" {
+		t.Errorf("got foreign key %+v, want (pa, pb) referencing parent(a, b) on delete cascade", fk)
+	}
+	if _, err = sqlite3_js.ReadTable(ctx, conn, "nope"); err == nil {
+		t.Errorf("expected error reading missing table, got nil")
+	}
+}
+
+func TestExplainQueryPlan(t *testing.T) {
+	db := newDB(t, `CREATE TABLE foo(id INTEGER PRIMARY KEY, name TEXT); CREATE TABLE bar(foo_id INTEGER, n INTEGER);
+		INSERT INTO foo VALUES(1, 'one'); INSERT INTO bar VALUES(1, 2)`)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	plan, err := sqlite3_js.ExplainQueryPlan(ctx, conn, "SELECT name FROM foo WHERE id = ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || !strings.HasPrefix(plan[0].Detail, "SEARCH foo") {
+		t.Errorf("got plan %+v, want a search of foo", plan)
+	}
+	plan, err = sqlite3_js.ExplainQueryPlan(ctx, conn, "SELECT * FROM foo WHERE id IN (SELECT foo_id FROM bar)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var children int
+	for _, n := range plan {
+		children += len(n.Children)
+		for _, c := range n.Children {
+			if c.Parent != n.ID {
+				t.Errorf("got child %+v of %+v", c, n)
+			}
+		}
+	}
+	if children == 0 {
+		t.Errorf("got plan %+v, want the subquery nested", plan)
+	}
+
+	logger := &testLogger{}
+	sql.Register("sqlite3_js_slow", &sqlite3_js.SqliteJsDriver{Logger: logger, SlowPlans: &sqlite3_js.SlowPlanOptions{FullScans: true}})
+	slowDB, err := sql.Open("sqlite3_js_slow", "slow.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = slowDB.Exec("CREATE TABLE foo(id INTEGER PRIMARY KEY, name TEXT); INSERT INTO foo VALUES(1, 'one')"); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, slowDB, "SELECT name FROM foo WHERE id = 1", []string{"one"})
+	assertStored(t, slowDB, "SELECT id FROM foo WHERE name = 'one'", []string{"1"})
+	var slow []logEvent
+	for _, e := range logger.events {
+		if e.msg == "slow plan" {
+			slow = append(slow, e)
+		}
+	}
+	if len(slow) != 1 || slow[0].level != sqlite3_js.LogWarn || slow[0].fields[sqlite3_js.FieldSQL] != "SELECT id FROM foo WHERE name = 'one'" {
+		t.Fatalf("got slow plan events %v, want the full scan of foo", slow)
+	}
+	if p, _ := slow[0].fields[sqlite3_js.FieldPlan].(string); !strings.Contains(p, "SCAN foo") {
+		t.Errorf("got plan %q, want a scan of foo", p)
+	}
+}
@@ -0,0 +1,218 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatementStats are the statistics aggregated over the statements run with the same normalized
+// SQL, where literals are replaced with ? and whitespace and comments are collapsed.
+type StatementStats struct {
+	SQL          string // normalized
+	Calls        int64
+	TotalTime    time.Duration
+	MaxTime      time.Duration
+	RowsReturned int64
+	RowsChanged  int64
+	Errors       int64
+	// Counters of sqlite3_stmt_status, which stay zero for backends which don't expose it.
+	FullScanSteps int64
+	Sorts         int64
+	AutoIndexes   int64
+}
+
+// maxStats bounds the number of normalized statements tracked, and of SQL texts whose
+// normalization is remembered. Statements normalizing to new SQL once it is reached are not
+// tracked until the statistics are reset.
+const maxStats = 1000
+
+// stmtStatus holds the sqlite3_stmt_status counters of a statement.
+type stmtStatus struct {
+	fullScanSteps, sorts, autoIndexes int64
+}
+
+type statsRegistry struct {
+	mu       sync.Mutex
+	stats    map[string]*StatementStats // by normalized SQL
+	keys     map[string]string          // normalized SQL by SQL, to normalize each statement once
+	disabled int32                      // set by SetStatsEnabled(false); accessed atomically
+}
+
+var stmtStats statsRegistry
+
+// Stats returns the statistics of the statements run by the drivers of this package since they
+// were last reset, in decreasing order of total time. Outside of js/wasm, where statements are
+// run by the native driver, there are none.
+func Stats() []StatementStats {
+	stmtStats.mu.Lock()
+	defer stmtStats.mu.Unlock()
+	stats := make([]StatementStats, 0, len(stmtStats.stats))
+	for _, st := range stmtStats.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalTime > stats[j].TotalTime
+	})
+	return stats
+}
+
+// SetStatsEnabled turns the gathering of statistics on or off; it is on by default. Turning it
+// off also saves reading the sqlite3_stmt_status counters of each statement run, which takes a
+// round trip for backends running SQLite in a worker.
+func SetStatsEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&stmtStats.disabled, disabled)
+}
+
+// enabled reports whether statistics are gathered.
+func (r *statsRegistry) enabled() bool {
+	return atomic.LoadInt32(&r.disabled) == 0
+}
+
+// ResetStats discards the statistics gathered so far.
+func ResetStats() {
+	stmtStats.mu.Lock()
+	defer stmtStats.mu.Unlock()
+	stmtStats.stats = nil
+	stmtStats.keys = nil
+}
+
+// record adds a run of the statement sql, described by ev, to the statistics.
+func (r *statsRegistry) record(sql string, ev TraceEvent, status stmtStatus) {
+	if !r.enabled() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keys[sql]
+	if !ok {
+		key = normalizeSQL(sql)
+		if r.keys == nil {
+			r.keys = make(map[string]string)
+			r.stats = make(map[string]*StatementStats)
+		}
+		// texts with inlined literals may never be run again, so stop remembering them once
+		// full, but still aggregate them
+		if len(r.keys) < maxStats {
+			r.keys[sql] = key
+		}
+	}
+	st := r.stats[key]
+	if st == nil {
+		if len(r.stats) >= maxStats {
+			return
+		}
+		st = &StatementStats{SQL: key}
+		r.stats[key] = st
+	}
+	st.Calls++
+	st.TotalTime += ev.Duration
+	if ev.Duration > st.MaxTime {
+		st.MaxTime = ev.Duration
+	}
+	st.RowsReturned += ev.RowsScanned
+	st.RowsChanged += ev.RowsAffected
+	if ev.Err != nil {
+		st.Errors++
+	}
+	st.FullScanSteps += status.fullScanSteps
+	st.Sorts += status.sorts
+	st.AutoIndexes += status.autoIndexes
+}
+
+// normalizeSQL replaces the string, blob and numeric literals of query with ?, drops comments
+// and collapses whitespace, so that statements differing only by those are aggregated together.
+func normalizeSQL(query string) string {
+	var b strings.Builder
+	space := false
+	isIdent := func(c byte) bool {
+		return c == '_' || c == '$' || c >= 0x80 || (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'z')
+	}
+	write := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+	skipTo := func(i int, end string) int {
+		j := strings.Index(query[i:], end)
+		if j < 0 {
+			return len(query)
+		}
+		return i + j + len(end)
+	}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			space = true
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			space = true
+			i = skipTo(i+2, "\n")
+		case strings.HasPrefix(query[i:], "/*"):
+			space = true
+			i = skipTo(i+2, "*/")
+		case c == '\'':
+			write("?")
+			// '' escapes a quote inside a string
+			for i = skipTo(i+1, "'"); i < len(query) && query[i] == '\''; {
+				i = skipTo(i+1, "'")
+			}
+		case (c == 'x' || c == 'X') && i+1 < len(query) && query[i+1] == '\'' && (i == 0 || !isIdent(query[i-1])):
+			write("?")
+			i = skipTo(i+2, "'")
+		case c == '"' || c == '`' || c == '[':
+			end := string(c)
+			if c == '[' {
+				end = "]"
+			}
+			j := skipTo(i+1, end)
+			write(query[i:j])
+			i = j
+		case (c >= '0' && c <= '9' || c == '.' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9') &&
+			(i == 0 || !isIdent(query[i-1]) && query[i-1] != '?'):
+			write("?")
+			for i++; i < len(query) && (isIdent(query[i]) || query[i] == '.' ||
+				(query[i] == '+' || query[i] == '-') && query[i-1]|0x20 == 'e'); i++ {
+			}
+		case isIdent(c):
+			j := i + 1
+			for j < len(query) && isIdent(query[j]) {
+				j++
+			}
+			write(query[i:j])
+			i = j
+		default:
+			write(query[i : i+1])
+			i++
+		}
+	}
+	return strings.TrimRight(b.String(), "; ")
+}
+
+// DatabaseStats describe the memory and storage used by a database and its connections. The
+// memory is used by the SQLite build as a whole, shared by all databases opened with it.
+type DatabaseStats struct {
+	MemoryUsed      int64 // bytes allocated by SQLite, see sqlite3_memory_used, or -1 if unknown
+	MemoryHighwater int64 // most bytes allocated by SQLite at once, or -1 if unknown
+	HeapSize        int64 // bytes of wasm memory of the SQLite build, or -1 if unknown
+	PageCount       int64
+	PageSize        int64
+	FreelistCount   int64 // unused pages, which VACUUM frees
+	ImageSize       int64 // bytes of the serialized database, i.e. PageCount * PageSize
+	Conns           []ConnStats
+}
+
+// ConnStats describe an open connection to a database.
+type ConnStats struct {
+	Stmts int // live prepared statements, including those held by the statement cache
+	Rows  int // open rows
+}
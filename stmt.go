@@ -1,21 +1,33 @@
+//go:build js && wasm
+// +build js,wasm
+
 package sqlite3_js //nolint:golint
 
 import (
 	"context"
 	"database/sql/driver"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall/js"
+	"time"
 )
 
 // SqliteJsStmt implements driver.Stmt.
 type SqliteJsStmt struct {
-	c       *SqliteJsConn
-	js      js.Value // sql.js Statement: https://sql-js.github.io/sql.js/documentation/class/Statement.html
-	mu      sync.Mutex
-	closed  bool
-	cls     bool // wild guess: connection level statement?
-	hasNext bool
+	c         *SqliteJsConn
+	bs        BackendStmt
+	sql       string
+	cache     *stmtCache // the cache to return the statement to when closed, if any
+	cacheGen  uint64     // schema generation the statement was prepared at
+	mu        sync.Mutex
+	closed    bool
+	cls       bool // connection-level statement, closed along with its rows
+	hasNext   bool
+	batch     rowBatch // rows fetched ahead of hasNext
+	fetchSize int      // rows to fetch in the next batch
 }
 
 type namedValue struct {
@@ -52,7 +64,7 @@ func (s *SqliteJsStmt) ExecContext(ctx context.Context, args []driver.NamedValue
 // exec executes a query that doesn't return rows. Attempts to honor context timeout.
 func (s *SqliteJsStmt) exec(ctx context.Context, args []namedValue) (driver.Result, error) {
 	if ctx.Done() == nil {
-		return s.execSync(args)
+		return s.execSync(ctx, args)
 	}
 
 	type result struct {
@@ -60,14 +72,10 @@ func (s *SqliteJsStmt) exec(ctx context.Context, args []namedValue) (driver.Resu
 		err error
 	}
 	resultCh := make(chan result)
+	bs := s.bs // the goroutine may prepare the statement again, but not once ctx is done
 	go func() {
-		defer func() {
-			if perr := recover(); perr != nil {
-				fmt.Printf("SqliteJsStmt.exec panicked! nargs=%d err=%s", len(args), perr)
-				resultCh <- result{nil, fmt.Errorf("SqliteJsStmt.exec panicked! nargs=%d err=%s", len(args), perr)}
-			}
-		}()
-		r, err := s.execSync(args)
+		defer protect(s.c.log, "SqliteJsStmt.exec", func(e error) { resultCh <- result{nil, e} })
+		r, err := s.execSync(ctx, args)
 		resultCh <- result{r, err}
 	}()
 	select {
@@ -77,61 +85,86 @@ func (s *SqliteJsStmt) exec(ctx context.Context, args []namedValue) (driver.Resu
 		select {
 		case <-resultCh: // no need to interrupt
 		default:
-			// FIXME: find a way to actually interrupt the connection
-			// this is still racy and can be no-op if executed between sqlite3_* calls in execSync.
-			// C.sqlite3_interrupt(s.c.db)
+			// only backends running SQLite off this thread can be interrupted, e.g. in a worker
+			stmtInterrupt(bs)
 			<-resultCh // ensure goroutine completed
 		}
 		return nil, ctx.Err()
 	}
 }
 
-func (s *SqliteJsStmt) execSync(args []namedValue) (driver.Result, error) {
-	// We're going to issue a bunch of JS calls, some of which (last rowid)
-	// are NOT statement-level scoped, but connection-level scoped, so we cannot just
+func (s *SqliteJsStmt) execSync(ctx context.Context, args []namedValue) (driver.Result, error) {
+	// The last rowid and changes we read along with running the statement are NOT
+	// statement-level scoped, but connection-level scoped, so we cannot just
 	// lock the statement mutex we have already, otherwise multiple goroutines may
 	// exec in this function, causing the last insert rowid to be wrong.
 	s.c.mu.Lock()
 	defer s.c.mu.Unlock()
 
-	jsArgs := make([]interface{}, len(args))
-	for i, v := range args {
-		if bval, ok := v.Value.([]byte); ok {
-			dst := js.Global().Get("Uint8Array").New(len(bval))
-			js.CopyBytesToJS(dst, bval)
-			jsArgs[i] = dst
-		} else {
-			jsArgs[i] = js.ValueOf(v.Value)
-		}
+	ev := TraceEvent{SQL: s.sql, Args: len(args)}
+	if s.c.tr != nil {
+		ctx = s.c.tr.OnExecStart(ctx, ev)
 	}
-	result, err := jsTryCatch(func() js.Value { return s.js.Call("run", jsArgs) })
-	if err != nil {
-		return nil, fmt.Errorf("execSync sql.js: %s", err)
+	start := time.Now()
+	changes, id, err := stmtExec(s.c.db.bdb, s.bs, driverValues(args))
+	if err != nil && ctx.Err() == nil && s.reprepare() {
+		changes, id, err = stmtExec(s.c.db.bdb, s.bs, driverValues(args))
+	}
+	s.c.logStmt("exec", s.sql, start, err)
+	ev.Duration, ev.RowsAffected, ev.Err = time.Since(start), changes, err
+	// once canceled, don't wait on a worker which may still be running the statement
+	var status stmtStatus
+	var statusOK bool
+	if ctx.Err() == nil {
+		status, statusOK = s.c.readStatus(s.bs)
+	}
+	stmtStats.record(s.sql, ev, status)
+	if err == nil {
+		s.c.logSlowPlan(s.sql, driverValues(args), ev.Duration, status, statusOK)
+	}
+	if s.c.tr != nil {
+		s.c.tr.OnExecEnd(ctx, ev)
 	}
-
-	// TODO: Kinda sucks each exec is paired with 2 extra calls but we have to do it ASAP else we risk
-	// getting out of sync with subsequent inserts.
-	rowsModified := s.c.JsDb.Call("getRowsModified")
-
-	rowidRes, err := jsTryCatch(func() js.Value {
-		rows := s.c.JsDb.Call("exec", "SELECT last_insert_rowid()")
-		if rows.Length() != 1 { // query result
-			// this gets recover()d and turns into an error
-			panic(fmt.Sprintf("last_insert_rowid: expected 1 row to be returned, got %d", rows.Length()))
-		}
-		// 'rows' is of the form: [{columns: ['id'], values:[[1],[2],[3]]}]
-		return rows.Index(0).Get("values").Index(0).Index(0)
-	})
 	if err != nil {
-		return nil, fmt.Errorf("execSync: error getting rowid: %s", err)
+		// the statement may be unusable, e.g. freed by Database.export(), so don't cache it
+		s.cache = nil
+		return nil, fmt.Errorf("execSync: %w", err)
+	}
+	if isSchemaChange(s.sql) {
+		atomic.AddUint64(&s.c.db.schemaGen, 1)
 	}
 	return &SqliteJsResult{
-		js:      result,
-		changes: int64(rowsModified.Int()),
-		id:      int64(rowidRes.Int()),
+		changes: changes,
+		id:      id,
 	}, nil
 }
 
+// reprepare prepares the statement again if it was taken from the cache and has since been freed
+// behind the driver's back, as sql.js does to every statement on Database.export(). It reports
+// whether it did, so that the failed call can be retried. A freed statement fails before it
+// runs, so retrying doesn't run it twice.
+func (s *SqliteJsStmt) reprepare() bool {
+	if s.cache == nil || !stmtFreed(s.bs) {
+		return false
+	}
+	bs, _, err := s.c.db.bdb.Prepare(s.sql)
+	if err != nil || bs == nil {
+		return false
+	}
+	_ = s.bs.Finalize()
+	s.bs = bs
+	return true
+}
+
+// driverValues returns the values of args.
+func driverValues(args []namedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, v := range args {
+		values[i] = v.Value
+	}
+	return values
+}
+
 // Query executes a query that may return rows, such as a
 // SELECT.
 //
@@ -160,37 +193,61 @@ func (s *SqliteJsStmt) QueryContext(ctx context.Context, args []driver.NamedValu
 }
 
 func (s *SqliteJsStmt) query(ctx context.Context, args []namedValue) (driver.Rows, error) {
-	jsArgs := make([]interface{}, len(args))
-	for i, v := range args {
-		if bval, ok := v.Value.([]byte); ok {
-			dst := js.Global().Get("Uint8Array").New(len(bval))
-			js.CopyBytesToJS(dst, bval)
-			jsArgs[i] = dst
-		} else {
-			jsArgs[i] = js.ValueOf(v.Value)
-		}
+	r := &SqliteJsRows{
+		s:        s,
+		cls:      s.cls,
+		ctx:      ctx,
+		bound:    driverValues(args),
+		trace:    TraceEvent{SQL: s.sql, Args: len(args)},
+		traceCtx: ctx,
 	}
-	jsOk := s.js.Call("bind", jsArgs)
-	if !jsOk.Bool() {
-		return nil, fmt.Errorf("failed to bind query")
+	if s.c.tr != nil {
+		r.traceCtx = s.c.tr.OnQueryStart(ctx, r.trace)
 	}
-	res := s.js.Call("step")
-	s.hasNext = res.Bool()
-
-	return &SqliteJsRows{
-		s:   s,
-		cls: s.cls, // FIXME: we never set s.cls, as we haven't implemented conn.Query(), which would set it
-		ctx: ctx,
-	}, nil
+	r.start = time.Now()
+	err := s.bs.Bind(r.bound)
+	if err != nil && s.reprepare() {
+		err = s.bs.Bind(r.bound)
+	}
+	if err != nil {
+		s.c.logStmt("query", s.sql, r.start, err)
+		r.trace.Err = err
+		r.endResultSet()
+		// the statement may be unusable, e.g. freed by Database.export(), so don't cache it
+		s.cache = nil
+		return nil, fmt.Errorf("failed to bind query: %w", err)
+	}
+	hasNext, err := s.bs.Step()
+	s.c.logStmt("query", s.sql, r.start, err)
+	if err != nil {
+		r.trace.Err = err
+		r.endResultSet()
+		s.cache = nil
+		return nil, err
+	}
+	s.hasNext = hasNext
+	s.batch = rowBatch{}
+	s.fetchSize = 0
+	atomic.AddInt32(&s.c.rows, 1)
+	return r, nil
 }
 
+// Next returns the current row of the statement as a JS array and steps past it, or nil once
+// there are no rows left. Rows fetched ahead in a batch by SqliteJsRows are not returned.
 func (s *SqliteJsStmt) Next() *js.Value {
 	if !s.hasNext {
 		return nil
 	}
-	row := s.js.Call("get")
-	jsHasNext := s.js.Call("step")
-	s.hasNext = jsHasNext.Bool()
+	cols, err := s.bs.ColumnNames()
+	if err != nil {
+		return nil
+	}
+	dest := make([]driver.Value, len(cols))
+	if err = s.bs.Row(dest); err != nil {
+		return nil
+	}
+	s.hasNext, _ = s.bs.Step()
+	row := js.ValueOf(toJSArgs(dest))
 	return &row
 }
 
@@ -207,18 +264,111 @@ func (s *SqliteJsStmt) NumInput() int {
 	return -1
 }
 
+// numParams returns the number of placeholders in the statement.
+func (s *SqliteJsStmt) numParams() int {
+	return s.bs.NumParams()
+}
+
+// countParams counts the placeholders in a single SQL statement the way sqlite3_bind_parameter_count
+// does: ?NNN sets the index explicitly, while a bare ? or a new :AAA, @AAA or $AAA takes the next
+// one. String literals, quoted identifiers and comments are skipped.
+func countParams(query string) int {
+	n := 0
+	named := make(map[string]bool)
+	skipTo := func(i int, end string) int {
+		j := strings.Index(query[i:], end)
+		if j < 0 {
+			return len(query)
+		}
+		return i + j + len(end) - 1
+	}
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\'', '"', '`':
+			i = skipTo(i+1, string(c))
+		case '[':
+			i = skipTo(i+1, "]")
+		case '-':
+			if strings.HasPrefix(query[i:], "--") {
+				i = skipTo(i+2, "\n")
+			}
+		case '/':
+			if strings.HasPrefix(query[i:], "/*") {
+				i = skipTo(i+2, "*/")
+			}
+		case '?':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j == i+1 {
+				n++
+				continue
+			}
+			if idx, err := strconv.Atoi(query[i+1 : j]); err == nil && idx > n {
+				n = idx
+			}
+			i = j - 1
+		case ':', '@', '$':
+			j := i + 1
+			for j < len(query) && (query[j] == '_' || query[j] >= 0x80 ||
+				(query[j] >= '0' && query[j] <= '9') || (query[j]|0x20 >= 'a' && query[j]|0x20 <= 'z')) {
+				j++
+			}
+			if j == i+1 {
+				continue
+			}
+			if name := query[i:j]; !named[name] {
+				named[name] = true
+				n++
+			}
+			i = j - 1
+		}
+	}
+	return n
+}
+
+// isBlankSQL reports whether query holds no statements, i.e. nothing but whitespace, semicolons
+// and comments.
+func isBlankSQL(query string) bool {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == ';' || c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		case strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				return true
+			}
+			i += j
+		case strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return true
+			}
+			i += j + 3
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // Close closes the statement.
 func (s *SqliteJsStmt) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.closeLocked()
+}
+
+// closeLocked frees the statement; must be called with locked mutex.
+func (s *SqliteJsStmt) closeLocked() error {
 	if s.closed {
 		return nil
 	}
 	s.closed = true
-
-	res := s.js.Call("free")
-	if !res.Bool() {
-		return fmt.Errorf("couldn't close stmt")
+	if s.cache != nil {
+		return s.cache.put(s.sql, s.bs, s.cacheGen)
 	}
-	return nil
+	atomic.AddInt32(&s.c.stmts, -1)
+	return s.bs.Finalize()
 }
@@ -0,0 +1,34 @@
+package sqlite3_js //nolint:golint
+
+import (
+	"context"
+	"time"
+)
+
+// TraceEvent describes a statement to the callbacks of a Tracer.
+type TraceEvent struct {
+	SQL          string
+	Args         int           // number of args the statement is run with
+	Duration     time.Duration // time taken, for the callbacks which end a trace
+	RowsScanned  int64         // rows read by the query, for OnRowsClosed
+	RowsAffected int64         // rows changed by the statement, for OnExecEnd
+	Err          error         // the error the statement failed with, if any
+}
+
+// Tracer traces the statements run by a driver, e.g. to find slow queries or to attach spans
+// to the traces propagated in contexts. The start callbacks return the context passed to the
+// matching end callback, so that they may carry a span from one to the other.
+type Tracer interface {
+	// OnPrepare is called once a statement has been prepared, or failed to, including the
+	// statements prepared for Exec and Query on the connection.
+	OnPrepare(ctx context.Context, ev TraceEvent)
+	// OnExecStart is called before a statement which doesn't return rows is run.
+	OnExecStart(ctx context.Context, ev TraceEvent) context.Context
+	// OnExecEnd is called once the statement has been run.
+	OnExecEnd(ctx context.Context, ev TraceEvent)
+	// OnQueryStart is called before a query is run.
+	OnQueryStart(ctx context.Context, ev TraceEvent) context.Context
+	// OnRowsClosed is called when the rows of the query are closed, or straight away if the
+	// query fails. The duration runs from the start of the query until then.
+	OnRowsClosed(ctx context.Context, ev TraceEvent)
+}